@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Directory where transfers uploaded with archive=true keep a copy (e.g., /var/lib/streamer/archive).
+// Archiving is disabled when empty.
+var archiveDir = os.Getenv("ARCHIVE_DIR")
+
+var errArchiveFailed = errors.New("The file could not be archived.")
+
+// archive is the copy of a transfer written to archiveDir as it is relayed.
+// It is kept under the file name only once the whole file was relayed.
+type archive struct {
+	file *os.File
+	kept bool
+}
+
+// newArchive creates a partial copy in archiveDir.
+func newArchive() (*archive, error) {
+	file, err := os.CreateTemp(archiveDir, ".streamer-*.partial")
+	if err != nil {
+		return nil, err
+	}
+	return &archive{file: file}, nil
+}
+
+// Write appends p to the copy.
+func (a *archive) Write(p []byte) (int, error) {
+	return a.file.Write(p)
+}
+
+// keep completes the copy as the file name, prefixed with the time the
+// transfer started so that transfers of the same name don't replace each
+// other. It returns the name of the archived file.
+func (a *archive) keep(fileName string, started time.Time) (string, error) {
+	if err := a.file.Sync(); err != nil {
+		return "", err
+	}
+	if err := a.file.Close(); err != nil {
+		return "", err
+	}
+	name := started.UTC().Format("20060102T150405.000Z") + "_" + fileName
+	if err := os.Rename(a.file.Name(), filepath.Join(archiveDir, name)); err != nil {
+		return "", err
+	}
+	a.kept = true
+	return name, nil
+}
+
+// close removes the copy unless it was kept.
+func (a *archive) close() {
+	if a.kept {
+		return
+	}
+	a.file.Close()
+	os.Remove(a.file.Name())
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Destination of the audit log of security events: an append-only file (e.g., /var/log/streamer/audit.log),
+// or syslog for the local syslog daemon. Disabled when empty.
+var auditLog = os.Getenv("AUDIT_LOG")
+
+var auditWriter io.Writer
+var auditMutex sync.Mutex
+
+// auditEvent is a line of the audit log.
+type auditEvent struct {
+	Time     time.Time `json:"time"`
+	Event    string    `json:"event"`
+	Actor    string    `json:"actor,omitempty"` // User name presented by the client, if any.
+	IP       string    `json:"ip"`
+	Request  string    `json:"request"`
+	ID       string    `json:"id,omitempty"`
+	FileName string    `json:"file_name,omitempty"`
+	Detail   string    `json:"detail,omitempty"`
+}
+
+// openAuditLog opens the destination of AUDIT_LOG.
+func openAuditLog() {
+	if auditLog == "" {
+		return
+	}
+	if auditLog == "syslog" {
+		w, err := openSyslog()
+		if err != nil {
+			log.Panicf("Error connecting to syslog. %s", err)
+		}
+		auditWriter = w
+		return
+	}
+	f, err := os.OpenFile(auditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Panicf("Error opening audit log. %s", err)
+	}
+	auditWriter = f
+}
+
+// audit records a security event caused by r, about the transfer with the
+// given ID and file name if any.
+func audit(r *http.Request, event string, id string, fileName string, detail string) {
+	if auditWriter == nil {
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	line, err := json.Marshal(auditEvent{
+		Time:     time.Now().UTC(),
+		Event:    event,
+		Actor:    user,
+		IP:       clientIP(r),
+		Request:  r.Method + " " + r.URL.Path,
+		ID:       id,
+		FileName: fileName,
+		Detail:   detail,
+	})
+	if err != nil {
+		log.Printf("Error encoding audit event. %s", err)
+		return
+	}
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+	if _, err := auditWriter.Write(append(line, '\n')); err != nil {
+		log.Printf("Error writing audit log. %s", err)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// BLAKE3 with the default 32-byte output, in the unkeyed hashing mode.
+
+const (
+	blake3BlockLen   = 64
+	blake3ChunkLen   = 1024
+	blake3ChunkStart = 1 << 0
+	blake3ChunkEnd   = 1 << 1
+	blake3Parent     = 1 << 2
+	blake3Root       = 1 << 3
+)
+
+var blake3IV = [8]uint32{0x6A09E667, 0xBB67AE85, 0x3C6EF372, 0xA54FF53A, 0x510E527F, 0x9B05688C, 0x1F83D9AB, 0x5BE0CD19}
+
+var blake3Permutation = [16]int{2, 6, 3, 10, 7, 0, 4, 13, 1, 11, 12, 5, 9, 14, 15, 8}
+
+func blake3G(s *[16]uint32, a, b, c, d int, mx, my uint32) {
+	s[a] += s[b] + mx
+	s[d] = bits.RotateLeft32(s[d]^s[a], -16)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -12)
+	s[a] += s[b] + my
+	s[d] = bits.RotateLeft32(s[d]^s[a], -8)
+	s[c] += s[d]
+	s[b] = bits.RotateLeft32(s[b]^s[c], -7)
+}
+
+// blake3Compress returns the first 8 words of the compression of block.
+func blake3Compress(cv *[8]uint32, block *[16]uint32, counter uint64, blockLen uint32, flags uint32) [8]uint32 {
+	s := [16]uint32{
+		cv[0], cv[1], cv[2], cv[3], cv[4], cv[5], cv[6], cv[7],
+		blake3IV[0], blake3IV[1], blake3IV[2], blake3IV[3],
+		uint32(counter), uint32(counter >> 32), blockLen, flags,
+	}
+	m := *block
+	for round := 0; round < 7; round++ {
+		blake3G(&s, 0, 4, 8, 12, m[0], m[1])
+		blake3G(&s, 1, 5, 9, 13, m[2], m[3])
+		blake3G(&s, 2, 6, 10, 14, m[4], m[5])
+		blake3G(&s, 3, 7, 11, 15, m[6], m[7])
+		blake3G(&s, 0, 5, 10, 15, m[8], m[9])
+		blake3G(&s, 1, 6, 11, 12, m[10], m[11])
+		blake3G(&s, 2, 7, 8, 13, m[12], m[13])
+		blake3G(&s, 3, 4, 9, 14, m[14], m[15])
+		var permuted [16]uint32
+		for i, j := range blake3Permutation {
+			permuted[i] = m[j]
+		}
+		m = permuted
+	}
+	var out [8]uint32
+	for i := range out {
+		out[i] = s[i] ^ s[i+8]
+	}
+	return out
+}
+
+func blake3Words(b []byte) *[16]uint32 {
+	var block [blake3BlockLen]byte
+	copy(block[:], b)
+	var words [16]uint32
+	for i := range words {
+		words[i] = binary.LittleEndian.Uint32(block[4*i:])
+	}
+	return &words
+}
+
+// blake3Hasher is a streaming BLAKE3 hash.Hash.
+type blake3Hasher struct {
+	stack [54][8]uint32 // Chaining values of completed subtrees.
+	depth int
+
+	cv       [8]uint32 // Chaining value of the current chunk.
+	chunk    uint64    // Index of the current chunk.
+	block    [blake3BlockLen]byte
+	blockLen int
+	blocks   int // Blocks of the current chunk compressed so far.
+}
+
+func newBLAKE3() hash.Hash {
+	h := &blake3Hasher{}
+	h.Reset()
+	return h
+}
+
+func (h *blake3Hasher) Reset() {
+	*h = blake3Hasher{cv: blake3IV}
+}
+
+func (h *blake3Hasher) Size() int      { return 32 }
+func (h *blake3Hasher) BlockSize() int { return blake3BlockLen }
+
+func (h *blake3Hasher) startFlag() uint32 {
+	if h.blocks == 0 {
+		return blake3ChunkStart
+	}
+	return 0
+}
+
+func (h *blake3Hasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		if h.blocks*blake3BlockLen+h.blockLen == blake3ChunkLen {
+			// The chunk is complete and more input follows.
+			cv := blake3Compress(&h.cv, blake3Words(h.block[:]), h.chunk, blake3BlockLen, h.startFlag()|blake3ChunkEnd)
+			h.pushChunk(cv)
+		}
+		if h.blockLen == blake3BlockLen {
+			// The block is complete and more input follows.
+			h.cv = blake3Compress(&h.cv, blake3Words(h.block[:]), h.chunk, blake3BlockLen, h.startFlag())
+			h.blocks++
+			h.blockLen = 0
+		}
+		m := copy(h.block[h.blockLen:], p)
+		h.blockLen += m
+		p = p[m:]
+	}
+	return n, nil
+}
+
+// pushChunk adds the chaining value of a completed chunk to the tree, merging
+// the subtrees it completes, and starts the next chunk.
+func (h *blake3Hasher) pushChunk(cv [8]uint32) {
+	total := h.chunk + 1
+	for total&1 == 0 {
+		h.depth--
+		cv = blake3ParentCV(&h.stack[h.depth], &cv, 0)
+		total >>= 1
+	}
+	h.stack[h.depth] = cv
+	h.depth++
+	h.chunk++
+	h.cv = blake3IV
+	h.blocks = 0
+	h.blockLen = 0
+}
+
+func blake3ParentCV(left, right *[8]uint32, flags uint32) [8]uint32 {
+	var block [16]uint32
+	copy(block[:8], left[:])
+	copy(block[8:], right[:])
+	return blake3Compress(&blake3IV, &block, 0, blake3BlockLen, blake3Parent|flags)
+}
+
+func (h *blake3Hasher) Sum(b []byte) []byte {
+	var out [8]uint32
+	if h.depth == 0 {
+		out = blake3Compress(&h.cv, blake3Words(h.block[:h.blockLen]), h.chunk, uint32(h.blockLen), h.startFlag()|blake3ChunkEnd|blake3Root)
+	} else {
+		cv := blake3Compress(&h.cv, blake3Words(h.block[:h.blockLen]), h.chunk, uint32(h.blockLen), h.startFlag()|blake3ChunkEnd)
+		for i := h.depth - 1; i > 0; i-- {
+			cv = blake3ParentCV(&h.stack[i], &cv, 0)
+		}
+		out = blake3ParentCV(&h.stack[0], &cv, blake3Root)
+	}
+	for _, w := range out {
+		b = binary.LittleEndian.AppendUint32(b, w)
+	}
+	return b
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"sort"
+)
+
+// publicTransfer is the JSON description of a transfer listed on the browse
+// page.
+type publicTransfer struct {
+	DownloadURL string `json:"download_url"`
+	transferMeta
+}
+
+var browseTemplate = template.Must(template.New("browse").Funcs(template.FuncMap{
+	"size": func(size *int64) string {
+		if size == nil {
+			return "unknown"
+		}
+		return formatBytes(*size)
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Available files</title>
+</head>
+<body style="font-family: sans-serif; color: #222; line-height: 1.5">
+<h1>Available files</h1>
+{{if .}}<table cellpadding="6">
+<tr><th align="left">Name</th><th align="right">Size</th><th align="left">Expires</th><th align="left">Note</th></tr>
+{{range .}}<tr><td><a href="{{.DownloadURL}}">{{.Name}}</a></td><td align="right">{{size .Size}}</td><td>{{.Expires.Format "Mon, 02 Jan 2006 15:04 MST"}}</td><td>{{.Note}}</td></tr>
+{{end}}</table>
+{{else}}<p>No files are available right now.</p>
+{{end}}</body>
+</html>
+`))
+
+// browse lists the transfers their uploaders made public that are still
+// waiting for a client, as HTML for browsers or JSON.
+func browse(w http.ResponseWriter, r *http.Request) {
+	list := []publicTransfer{}
+	clientsRWMutex.RLock()
+	for fileID, client := range clients {
+		if !client.public || client.receiver != nil {
+			continue
+		}
+		list = append(list, publicTransfer{
+			DownloadURL:  fmt.Sprintf("%s/%s/%s", baseURL(r), prefix, fileID),
+			transferMeta: client.meta(),
+		})
+	}
+	clientsRWMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	w.Header().Set("Cache-Control", "no-store")
+	if acceptsHTML(r) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		browseTemplate.Execute(w, list)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
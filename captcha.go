@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// CAPTCHA service that uploads to signed URLs must pass: hcaptcha or turnstile. Disabled when empty.
+var captchaProvider = os.Getenv("CAPTCHA_PROVIDER")
+
+// Secret key of the site registered with the CAPTCHA service.
+var captchaSecret = os.Getenv("CAPTCHA_SECRET")
+
+// Header that carries the CAPTCHA token of uploads that are not forms.
+const captchaHeader = "X-Streamer-Captcha"
+
+var errCaptchaRequired = errors.New("The upload must pass the CAPTCHA challenge.")
+var errCaptchaFailed = errors.New("The CAPTCHA challenge failed.")
+
+// captchaService is a CAPTCHA provider, with the endpoint that verifies its
+// tokens and the form field its widget adds to the upload form.
+type captchaService struct {
+	verifyURL string
+	field     string
+}
+
+var captchaServices = map[string]captchaService{
+	"hcaptcha":  {"https://api.hcaptcha.com/siteverify", "h-captcha-response"},
+	"turnstile": {"https://challenges.cloudflare.com/turnstile/v0/siteverify", "cf-turnstile-response"},
+}
+
+var captchaClient = &http.Client{Timeout: 10 * time.Second}
+
+// checkCaptchaConfig panics if CAPTCHA_PROVIDER is not known, or has no
+// secret.
+func checkCaptchaConfig() {
+	if captchaProvider == "" {
+		return
+	}
+	if _, ok := captchaServices[captchaProvider]; !ok {
+		log.Panicf("Unknown CAPTCHA_PROVIDER %q.", captchaProvider)
+	}
+	if captchaSecret == "" {
+		log.Panicf("CAPTCHA_SECRET is required with CAPTCHA_PROVIDER.")
+	}
+}
+
+// captchaRequired tells whether uploads without credentials must pass a
+// CAPTCHA challenge.
+func captchaRequired() bool {
+	return captchaProvider != ""
+}
+
+// captchaField returns the form field that carries the CAPTCHA token.
+func captchaField() string {
+	return captchaServices[captchaProvider].field
+}
+
+// verifyCaptcha asks the CAPTCHA service whether token was issued for the
+// client of r.
+func verifyCaptcha(r *http.Request, token string) error {
+	if token == "" {
+		return errCaptchaRequired
+	}
+	resp, err := captchaClient.PostForm(captchaServices[captchaProvider].verifyURL, url.Values{
+		"secret":   {captchaSecret},
+		"response": {token},
+		"remoteip": {clientIP(r)},
+	})
+	if err != nil {
+		log.Printf("Error verifying CAPTCHA. %s", err)
+		return errCaptchaFailed
+	}
+	defer resp.Body.Close()
+	var result struct {
+		Success bool `json:"success"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		log.Printf("Error decoding CAPTCHA verification. %s", err)
+		return errCaptchaFailed
+	}
+	if !result.Success {
+		return errCaptchaFailed
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Comma-separated list of origins allowed to make cross-origin requests (e.g., https://app.mydomain.com), or * for any.
+// CORS is disabled when empty.
+var corsAllowedOrigins = os.Getenv("CORS_ALLOWED_ORIGINS")
+
+// Comma-separated list of methods allowed in cross-origin requests.
+var corsAllowedMethods = os.Getenv("CORS_ALLOWED_METHODS")
+
+// Comma-separated list of request headers allowed in cross-origin requests.
+var corsAllowedHeaders = os.Getenv("CORS_ALLOWED_HEADERS")
+
+// Whether cross-origin requests may include credentials (true or false).
+var corsAllowCredentials = os.Getenv("CORS_ALLOW_CREDENTIALS") == "true"
+
+// Response headers browsers may read from cross-origin responses.
+const corsExposedHeaders = "Content-Disposition, Content-Length, X-Streamer-Expires, X-Streamer-Note"
+
+// checkCORSConfig panics if credentials are allowed from any origin, which
+// would let every website act with the credentials of the service's users.
+func checkCORSConfig() {
+	if !corsAllowCredentials {
+		return
+	}
+	for _, allowed := range strings.Split(corsAllowedOrigins, ",") {
+		if strings.TrimSpace(allowed) == "*" {
+			log.Panic("CORS_ALLOW_CREDENTIALS requires CORS_ALLOWED_ORIGINS to list the origins instead of *")
+		}
+	}
+}
+
+// corsAllowedOrigin returns the value of Access-Control-Allow-Origin for the
+// given request origin, or an empty string if the origin is not allowed.
+func corsAllowedOrigin(origin string) string {
+	if origin == "" {
+		return ""
+	}
+	for _, allowed := range strings.Split(corsAllowedOrigins, ",") {
+		allowed = strings.TrimSpace(allowed)
+		if allowed == "*" {
+			return "*"
+		}
+		if allowed != "" && strings.EqualFold(allowed, origin) {
+			return origin
+		}
+	}
+	return ""
+}
+
+// cors adds CORS headers to responses and answers preflight requests.
+func cors(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if corsAllowedOrigins == "" {
+			next(w, r)
+			return
+		}
+
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		origin := corsAllowedOrigin(r.Header.Get("Origin"))
+		if origin != "" {
+			h.Set("Access-Control-Allow-Origin", origin)
+			if corsAllowCredentials {
+				h.Set("Access-Control-Allow-Credentials", "true")
+			}
+			h.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+
+		if r.Method == "OPTIONS" {
+			// Preflight
+			if origin != "" && r.Header.Get("Access-Control-Request-Method") != "" {
+				h.Add("Vary", "Access-Control-Request-Method")
+				h.Add("Vary", "Access-Control-Request-Headers")
+				h.Set("Access-Control-Allow-Methods", corsAllowedMethods)
+				h.Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+				h.Set("Access-Control-Max-Age", "600")
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next(w, r)
+	}
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"crypto/sha256"
+	"hash"
+	"hash/crc32"
+	"strings"
+)
+
+// Algorithms of segment digests, keyed by their name in the Content-Digest
+// header. SHA-256 is the default. The others are faster when only corruption
+// needs to be detected.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"sha-256": sha256.New,
+	"blake3":  newBLAKE3,
+	"xxh3":    newXXH3,
+	"xxh64":   newXXH64,
+	"crc32c":  func() hash.Hash { return crc32.New(crc32.MakeTable(crc32.Castagnoli)) },
+}
+
+// Default algorithm of segment digests.
+const defaultDigestAlgorithm = "sha-256"
+
+// digestAlgorithm returns the canonical name of a digest algorithm, accepting
+// names without dashes such as sha256, or false if it is not supported.
+func digestAlgorithm(name string) (string, bool) {
+	name = strings.ToLower(name)
+	if name == "sha256" {
+		name = "sha-256"
+	}
+	_, ok := digestAlgorithms[name]
+	return name, ok
+}
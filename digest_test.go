@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/hex"
+	"hash"
+	"testing"
+)
+
+// pattern returns the test input of the reference implementations: n bytes
+// counting up modulo 251.
+func pattern(n int) []byte {
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = byte(i % 251)
+	}
+	return p
+}
+
+var digestTests = []struct {
+	algorithm string
+	input     []byte
+	want      string
+}{
+	{"blake3", pattern(0), "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+	{"blake3", pattern(1), "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+	{"blake3", []byte("abc"), "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+	{"blake3", pattern(63), "e9bc37a594daad83be9470df7f7b3798297c3d834ce80ba85d6e207627b7db7b"},
+	{"blake3", pattern(64), "4eed7141ea4a5cd4b788606bd23f46e212af9cacebacdc7d1f4c6dc7f2511b98"},
+	{"blake3", pattern(65), "de1e5fa0be70df6d2be8fffd0e99ceaa8eb6e8c93a63f2d8d1c30ecb6b263dee"},
+	{"blake3", pattern(1023), "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+	{"blake3", pattern(1024), "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+	{"blake3", pattern(1025), "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+	{"blake3", pattern(2048), "e776b6028c7cd22a4d0ba182a8bf62205d2ef576467e838ed6f2529b85fba24a"},
+	{"blake3", pattern(2049), "5f4d72f40d7a5f82b15ca2b2e44b1de3c2ef86c426c95c1af0b6879522563030"},
+	{"blake3", pattern(4096), "015094013f57a5277b59d8475c0501042c0b642e531b0a1c8f58d2163229e969"},
+	{"blake3", pattern(8193), "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+	{"blake3", pattern(100000), "d93c23eedaf165a7e0be908ba86f1a7a520d568d2d13cde787c8580c5c72cc54"},
+
+	{"xxh64", pattern(0), "ef46db3751d8e999"},
+	{"xxh64", pattern(1), "e934a84adb052768"},
+	{"xxh64", []byte("a"), "d24ec4f1a98c6e5b"},
+	{"xxh64", []byte("abc"), "44bc2cf5ad770999"},
+	{"xxh64", pattern(3), "e5c7bb4533bc65dd"},
+	{"xxh64", pattern(4), "ffced8604453cc1e"},
+	{"xxh64", pattern(8), "884a173614b81b8d"},
+	{"xxh64", pattern(9), "67d85784a7c78c5b"},
+	{"xxh64", pattern(16), "44b6ef2fb84169f7"},
+	{"xxh64", pattern(17), "5603e60c527599b6"},
+	{"xxh64", pattern(128), "7a7fe14647b9ab92"},
+	{"xxh64", pattern(129), "0ba25dfd6e891fcf"},
+	{"xxh64", pattern(240), "012947f0da6a27b1"},
+	{"xxh64", pattern(241), "8d643f23bf2808e1"},
+	{"xxh64", pattern(255), "566d96b832b967c1"},
+	{"xxh64", pattern(256), "f33944343ee85824"},
+	{"xxh64", pattern(1024), "138e26c65048ce29"},
+	{"xxh64", pattern(1025), "cfd73aedd2d6a39d"},
+	{"xxh64", pattern(2048), "a69e05a7eff57800"},
+	{"xxh64", pattern(4096), "122a8c8d994ad3ec"},
+	{"xxh64", pattern(100000), "4cf75ee72cd8f4cc"},
+
+	{"xxh3", pattern(0), "2d06800538d394c2"},
+	{"xxh3", pattern(1), "c44bdff4074eecdb"},
+	{"xxh3", []byte("a"), "e6c632b61e964e1f"},
+	{"xxh3", []byte("abc"), "78af5f94892f3950"},
+	{"xxh3", pattern(3), "5f4299fc161c9cbb"},
+	{"xxh3", pattern(4), "60dab036a58211f2"},
+	{"xxh3", pattern(8), "3a1c2d7c85af88f8"},
+	{"xxh3", pattern(9), "e9612598145bb9dc"},
+	{"xxh3", pattern(16), "8355e3a6f61770db"},
+	{"xxh3", pattern(17), "9ef341a99de37328"},
+	{"xxh3", pattern(128), "85c6174c7ff4c46b"},
+	{"xxh3", pattern(129), "ec7642b431ba3e5a"},
+	{"xxh3", pattern(240), "375a384d957fe865"},
+	{"xxh3", pattern(241), "02e8cd95421c6d02"},
+	{"xxh3", pattern(255), "074191baf9c49567"},
+	{"xxh3", pattern(256), "44f5d90dacde463a"},
+	{"xxh3", pattern(1024), "e5d78bafa45b2aa5"},
+	{"xxh3", pattern(1025), "e95c42288f28186e"},
+	{"xxh3", pattern(2048), "25339063db861586"},
+	{"xxh3", pattern(4096), "7135ffa504f1bc71"},
+	{"xxh3", pattern(100000), "42c23aeead96750d"},
+}
+
+func TestDigest(t *testing.T) {
+	for _, test := range digestTests {
+		h := digestAlgorithms[test.algorithm]()
+		h.Write(test.input)
+		if got := hex.EncodeToString(h.Sum(nil)); got != test.want {
+			t.Errorf("%s of %d bytes = %s, want %s", test.algorithm, len(test.input), got, test.want)
+		}
+	}
+}
+
+// TestDigestChunked writes the input in chunks of various sizes, summing
+// between them, since segments are hashed as they are read.
+func TestDigestChunked(t *testing.T) {
+	for _, test := range digestTests {
+		for _, chunk := range []int{1, 7, 31, 32, 33, 63, 64, 65, 255, 256, 257, 1000, 1024, 4099} {
+			h := digestAlgorithms[test.algorithm]()
+			if got := hex.EncodeToString(writeChunks(h, test.input, chunk)); got != test.want {
+				t.Errorf("%s of %d bytes in chunks of %d = %s, want %s", test.algorithm, len(test.input), chunk, got, test.want)
+			}
+		}
+	}
+}
+
+func TestDigestReset(t *testing.T) {
+	for _, test := range digestTests {
+		h := digestAlgorithms[test.algorithm]()
+		h.Write(pattern(5000))
+		h.Reset()
+		h.Write(test.input)
+		if got := hex.EncodeToString(h.Sum(nil)); got != test.want {
+			t.Errorf("%s of %d bytes after Reset = %s, want %s", test.algorithm, len(test.input), got, test.want)
+		}
+	}
+}
+
+// writeChunks writes p to h in chunks of size bytes and returns the sum.
+func writeChunks(h hash.Hash, p []byte, size int) []byte {
+	for len(p) > 0 {
+		n := size
+		if n > len(p) {
+			n = len(p)
+		}
+		h.Write(p[:n])
+		p = p[n:]
+		h.Sum(nil)
+	}
+	return h.Sum(nil)
+}
+
+func TestDigestAlgorithm(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"sha-256", "sha-256", true},
+		{"SHA256", "sha-256", true},
+		{"BLAKE3", "blake3", true},
+		{"xxh3", "xxh3", true},
+		{"xxh64", "xxh64", true},
+		{"crc32c", "crc32c", true},
+		{"md5", "md5", false},
+	}
+	for _, test := range tests {
+		if got, ok := digestAlgorithm(test.name); got != test.want || ok != test.ok {
+			t.Errorf("digestAlgorithm(%q) = %q, %v, want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// How long a shutdown waits for active transfers to complete (e.g., 60s).
+var drainTimeout time.Duration
+
+// Set once the server is shutting down and no longer accepts uploads.
+var draining atomic.Bool
+
+// Tracks registered transfers until their upload handler returns.
+var transfers sync.WaitGroup
+
+// How long aborted transfers get to report the abort before the server stops.
+const abortGracePeriod = 5 * time.Second
+
+// abort stops the transfer with err. A blocked read of the upload body is
+// interrupted so both sides can be told why. clientsRWMutex must be held.
+func (c *client) abort(err error) {
+	c.abortOnce.Do(func() {
+		c.abortErr = err
+		close(c.aborted)
+		if c.conn != nil {
+			c.conn.SetReadDeadline(time.Now())
+		}
+	})
+}
+
+// abortError returns the reason the transfer was aborted, or nil.
+func (c *client) abortError() error {
+	select {
+	case <-c.aborted:
+		return c.abortErr
+	default:
+		return nil
+	}
+}
+
+// drain stops accepting uploads, aborts transfers still waiting for a client
+// and gives active transfers up to timeout to complete before aborting them.
+func drain(timeout time.Duration) {
+	clientsRWMutex.Lock()
+	draining.Store(true)
+	wakeArrivals()
+	active := 0
+	for _, c := range clients {
+		if c.receiver == nil || !c.receiver.started {
+			c.abort(errShuttingDown)
+		} else {
+			active++
+		}
+	}
+	clientsRWMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		transfers.Wait()
+		close(done)
+	}()
+
+	if active > 0 {
+		log.Printf("Waiting up to %s for %d active transfers to complete...\n", timeout, active)
+	}
+	select {
+	case <-done:
+		return
+	case <-time.After(timeout):
+	}
+
+	clientsRWMutex.RLock()
+	for _, c := range clients {
+		c.abort(errShutDown)
+	}
+	log.Printf("Aborted %d transfers.\n", len(clients))
+	clientsRWMutex.RUnlock()
+
+	select {
+	case <-done:
+	case <-time.After(abortGracePeriod):
+	}
+}
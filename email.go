@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// SMTP server used to email download links (e.g., smtp.mydomain.com). Email delivery is disabled when empty.
+var smtpHost = os.Getenv("SMTP_HOST")
+
+// SMTP server port. Port 465 uses implicit TLS; other ports use STARTTLS when the server offers it.
+var smtpPort = os.Getenv("SMTP_PORT")
+
+// Credentials for the SMTP server, if it requires authentication.
+var smtpUser = os.Getenv("SMTP_USER")
+var smtpPassword = os.Getenv("SMTP_PASSWORD")
+
+// Sender address of link emails (e.g., Streamer <streamer@mydomain.com>).
+var smtpFrom = os.Getenv("SMTP_FROM")
+
+// Maximum number of recipients of a link email.
+const maxEmailRecipients = 10
+
+var emailTemplate = template.Must(template.New("email").Parse(`<!DOCTYPE html>
+<html>
+<body style="font-family: sans-serif; color: #222; line-height: 1.5">
+<p>A file was shared with you:</p>
+<p style="font-size: 1.2em"><strong>{{.Name}}</strong>{{if .Size}} ({{.Size}}){{end}}</p>
+{{if .Note}}<p style="white-space: pre-line; border-left: 3px solid #ccc; padding-left: 0.8em">{{.Note}}</p>
+{{end}}<p><a href="{{.URL}}" style="display: inline-block; padding: 0.6em 1.2em; background: #2563eb; color: #fff; text-decoration: none; border-radius: 4px">Download</a></p>
+<p style="color: #666; font-size: 0.9em">The link works once and expires {{.Expires}}. The download starts as soon as you open it, while the sender is still online.</p>
+</body>
+</html>
+`))
+
+// linkEmail is the content of an email with a download link.
+type linkEmail struct {
+	Name    string
+	Size    string
+	URL     string
+	Expires string
+	Note    string
+}
+
+// sendLinkEmail emails the download link of c to the recipients.
+func sendLinkEmail(c *client, to []string, downloadUrl string) error {
+	from, err := mail.ParseAddress(smtpFrom)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	content := linkEmail{
+		Name:    c.fileName,
+		URL:     downloadUrl,
+		Expires: c.expires.UTC().Format("Mon, 02 Jan 2006 15:04 MST"),
+		Note:    c.note,
+	}
+	if c.size >= 0 {
+		content.Size = formatBytes(c.size)
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, _ := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/plain; charset=utf-8"}, "Content-Transfer-Encoding": {"quoted-printable"}})
+	qp := quotedprintable.NewWriter(part)
+	fmt.Fprintf(qp, "A file was shared with you: %s", content.Name)
+	if content.Size != "" {
+		fmt.Fprintf(qp, " (%s)", content.Size)
+	}
+	if content.Note != "" {
+		fmt.Fprintf(qp, "\r\n\r\n%s", strings.ReplaceAll(content.Note, "\n", "\r\n"))
+	}
+	fmt.Fprintf(qp, "\r\n\r\nDownload it from %s\r\n\r\nThe link works once and expires %s.\r\n", content.URL, content.Expires)
+	qp.Close()
+	part, _ = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"text/html; charset=utf-8"}, "Content-Transfer-Encoding": {"quoted-printable"}})
+	qp = quotedprintable.NewWriter(part)
+	if err := emailTemplate.Execute(qp, content); err != nil {
+		return err
+	}
+	qp.Close()
+	mw.Close()
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	for _, addr := range to {
+		fmt.Fprintf(&msg, "To: %s\r\n", addr)
+	}
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", content.Name+" was shared with you"))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+
+	return sendMail(from.Address, to, msg.Bytes())
+}
+
+// sendMail delivers msg through the configured SMTP server.
+func sendMail(from string, to []string, msg []byte) error {
+	port := smtpPort
+	if port == "" {
+		port = "587"
+	}
+	addr := net.JoinHostPort(smtpHost, port)
+	var auth smtp.Auth
+	if smtpUser != "" {
+		auth = smtp.PlainAuth("", smtpUser, smtpPassword, smtpHost)
+	}
+	if port != "465" {
+		return smtp.SendMail(addr, auth, from, to, msg)
+	}
+
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", addr, &tls.Config{ServerName: smtpHost})
+	if err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, smtpHost)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+	if auth != nil {
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	for _, addr := range to {
+		if err := c.Rcpt(addr); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
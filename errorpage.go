@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	texttemplate "text/template"
+)
+
+// Directory of templates that replace the default error messages (e.g., /etc/streamer/errors).
+// A template is named after its error with a .txt extension for plain text or .html for browsers,
+// such as not_found.html. Errors without a template keep the default message.
+var errorTemplatesDir = os.Getenv("ERROR_TEMPLATES_DIR")
+
+// Support contact shown in error templates (e.g., support@mydomain.com).
+var supportContact = os.Getenv("SUPPORT_CONTACT")
+
+// Errors that can be customized with templates.
+var errorTemplateNames = []string{"not_found", "unauthorized", "busy", "timeout"}
+
+var errorTextTemplates = make(map[string]*texttemplate.Template)
+var errorHTMLTemplates = make(map[string]*template.Template)
+
+// errorPage holds the variables available to error templates.
+type errorPage struct {
+	Status   int    // HTTP status code.
+	Message  string // Default message.
+	FileName string // Name of the file, if the error is about a transfer.
+	Support  string // SUPPORT_CONTACT.
+}
+
+// loadErrorTemplates parses the templates in ERROR_TEMPLATES_DIR.
+func loadErrorTemplates() {
+	if errorTemplatesDir == "" {
+		return
+	}
+	for _, name := range errorTemplateNames {
+		path := filepath.Join(errorTemplatesDir, name+".txt")
+		if _, err := os.Stat(path); err == nil {
+			errorTextTemplates[name] = texttemplate.Must(texttemplate.ParseFiles(path))
+		}
+		path = filepath.Join(errorTemplatesDir, name+".html")
+		if _, err := os.Stat(path); err == nil {
+			errorHTMLTemplates[name] = template.Must(template.ParseFiles(path))
+		}
+	}
+}
+
+// writeError replies with the named error template, falling back to message
+// as plain text when there is no template for it.
+func writeError(w http.ResponseWriter, r *http.Request, name string, code int, message string, fileName string) {
+	page := errorPage{
+		Status:   code,
+		Message:  strings.TrimSpace(message),
+		FileName: fileName,
+		Support:  supportContact,
+	}
+	var body bytes.Buffer
+	contentType := "text/plain; charset=utf-8"
+	var err error
+	if t, ok := errorHTMLTemplates[name]; ok && acceptsHTML(r) {
+		contentType = "text/html; charset=utf-8"
+		err = t.Execute(&body, page)
+	} else if t, ok := errorTextTemplates[name]; ok {
+		err = t.Execute(&body, page)
+	} else {
+		http.Error(w, message, code)
+		return
+	}
+	if err != nil {
+		log.Printf("Error executing %s template. %s", name, err)
+		http.Error(w, message, code)
+		return
+	}
+	w.Header().Del("Content-Length")
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(code)
+	w.Write(body.Bytes())
+}
+
+// errorMessage returns the plain text template of the named error, or message
+// if there is none. It is used for errors reported in the upload status.
+func errorMessage(name string, message string, fileName string) string {
+	t, ok := errorTextTemplates[name]
+	if !ok {
+		return message
+	}
+	var body strings.Builder
+	if err := t.Execute(&body, errorPage{Message: message, FileName: fileName, Support: supportContact}); err != nil {
+		log.Printf("Error executing %s template. %s", name, err)
+		return message
+	}
+	return strings.TrimSpace(body.String())
+}
+
+// notFound replies with a 404 Not Found error.
+func notFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, "not_found", http.StatusNotFound, "404 page not found", "")
+}
+
+// acceptsHTML reports whether the request is from a browser asking for HTML.
+func acceptsHTML(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && mediaType == "text/html" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variable that hands listeners to a new process: the names of the listeners, one per line,
+// in the order of their file descriptors.
+const handoffEnv = "STREAMER_HANDOFF"
+
+// How long the old process waits for active transfers to complete after handing off its listeners (e.g., 24h).
+var handoffDrainTimeout time.Duration
+
+// namedListener is an open listener and the name the next process finds it by.
+type namedListener struct {
+	name string
+	l    net.Listener
+}
+
+// Listeners opened by this process, before any wrapping.
+var openListeners []namedListener
+
+// Listeners handed over by the previous process, keyed by name.
+var inheritedListeners = make(map[string]net.Listener)
+
+// inheritListeners takes the listeners handed over by the previous process,
+// if any.
+func inheritListeners() error {
+	names := os.Getenv(handoffEnv)
+	if names == "" {
+		return nil
+	}
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv(handoffEnv)
+	for i, name := range strings.Split(names, "\n") {
+		fd := listenFdsStart + i
+		f := os.NewFile(uintptr(fd), "HANDOFF_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		inheritedListeners[name] = l
+	}
+	return nil
+}
+
+// takeListener returns the listener handed over under the name
+// network:address, or opens it with listen.
+func takeListener(network, address string, listen func() (net.Listener, error)) (net.Listener, error) {
+	name := network + ":" + address
+	l, ok := inheritedListeners[name]
+	if ok {
+		delete(inheritedListeners, name)
+	} else {
+		var err error
+		if l, err = listen(); err != nil {
+			return nil, err
+		}
+	}
+	openListeners = append(openListeners, namedListener{name, l})
+	return l, nil
+}
+
+// inheritedActivatedListeners returns the socket activated listeners handed
+// over by the previous process.
+func inheritedActivatedListeners() []net.Listener {
+	var listeners []net.Listener
+	for i := 0; ; i++ {
+		name := "activated:" + strconv.Itoa(i)
+		l, ok := inheritedListeners[name]
+		if !ok {
+			return listeners
+		}
+		delete(inheritedListeners, name)
+		openListeners = append(openListeners, namedListener{name, l})
+		listeners = append(listeners, withProxyProtocol(l))
+	}
+}
+
+// closeUnusedListeners closes the handed over listeners that are no longer
+// configured.
+func closeUnusedListeners() {
+	for name, l := range inheritedListeners {
+		l.Close()
+		delete(inheritedListeners, name)
+	}
+}
+
+// handoff starts a new process of the current executable with the same
+// arguments that takes over the listeners of this one.
+func handoff() error {
+	if len(openListeners) == 0 {
+		return errors.New("no listeners to hand off")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(openListeners))
+	files := make([]*os.File, 0, len(openListeners))
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, nl := range openListeners {
+		fl, ok := nl.l.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s can't be handed off", nl.name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		names = append(names, nl.name)
+		files = append(files, f)
+	}
+
+	// The new process publishes the onion services again with their keys,
+	// which Tor only allows once they are released.
+	releaseOnions()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	cmd.Env = append(os.Environ(), handoffEnv+"="+strings.Join(names, "\n"))
+	if err := cmd.Start(); err != nil {
+		republishOnions()
+		return err
+	}
+	for _, nl := range openListeners {
+		// The socket file now belongs to the new process.
+		if ul, ok := nl.l.(*net.UnixListener); ok {
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	return cmd.Process.Release()
+}
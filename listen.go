@@ -0,0 +1,215 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Address the PORT listener binds to (e.g., 127.0.0.1). Binds to all interfaces when empty.
+var bindAddr = os.Getenv("BIND_ADDR")
+
+// Certificate and key files to serve HTTPS on the PORT listener.
+var tlsCertFile = os.Getenv("TLS_CERT_FILE")
+var tlsKeyFile = os.Getenv("TLS_KEY_FILE")
+
+// Comma-separated list of additional listeners, each with its own settings, e.g.
+// http://127.0.0.1:3000,https://:8443?cert=/etc/streamer/cert.pem&key=/etc/streamer/key.pem,unix:///run/streamer.sock?mode=0660
+var listenURLs = os.Getenv("LISTEN")
+
+// Whether any listener serves HTTPS.
+var tlsEnabled bool
+
+// Path of a Unix domain socket to listen on (e.g., /run/streamer/streamer.sock), for use behind a local proxy.
+// When set, the PORT listener is only started if PORT is set too.
+var unixSocket = os.Getenv("UNIX_SOCKET")
+
+// Permissions of the Unix domain socket in octal (e.g., 0660).
+var unixSocketMode = os.Getenv("UNIX_SOCKET_MODE")
+
+// First file descriptor passed by systemd socket activation.
+const listenFdsStart = 3
+
+// listen opens the configured listeners.
+func listen() []net.Listener {
+	if err := inheritListeners(); err != nil {
+		log.Fatalf("Error using handed off sockets. %s", err)
+	}
+	listeners, err := activatedListeners()
+	if err != nil {
+		log.Fatalf("Error using activated sockets. %s", err)
+	}
+
+	for _, spec := range strings.Split(listenURLs, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		l, err := listenURL(spec)
+		if err != nil {
+			log.Fatalf("Error listening on %s. %s", spec, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if unixSocket != "" {
+		mode, err := parseMode(unixSocketMode)
+		if err != nil {
+			log.Panicf("UNIX_SOCKET_MODE is not a valid octal mode: %q", unixSocketMode)
+		}
+		l, err := listenUnix(unixSocket, mode)
+		if err != nil {
+			log.Fatalf("Error listening on %s. %s", unixSocket, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	if port != "" || len(listeners) == 0 {
+		if port == "" {
+			port = "3000"
+		}
+		addr := net.JoinHostPort(bindAddr, port)
+		l, err := listenTCP(addr, tlsCertFile, tlsKeyFile, "")
+		if err != nil {
+			log.Fatalf("Error listening on %s. %s", addr, err)
+		}
+		listeners = append(listeners, l)
+	}
+
+	return listeners
+}
+
+// listenURL opens a listener described by a URL such as http://:3000,
+// https://:8443?cert=cert.pem&key=key.pem&min_tls=1.3,
+// unix:///run/streamer.sock?mode=0660 or
+// onion://127.0.0.1:9051?key=/var/lib/streamer/onion.key.
+func listenURL(spec string) (net.Listener, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	switch u.Scheme {
+	case "http", "tcp":
+		return listenTCP(u.Host, "", "", "")
+	case "https":
+		if query.Get("cert") == "" || query.Get("key") == "" {
+			return nil, errors.New("https listeners need cert and key files")
+		}
+		return listenTCP(u.Host, query.Get("cert"), query.Get("key"), query.Get("min_tls"))
+	case "unix":
+		mode, err := parseMode(query.Get("mode"))
+		if err != nil {
+			return nil, err
+		}
+		return listenUnix(u.Path, mode)
+	case "onion":
+		return listenOnion(u.Host, query.Get("key"), query.Get("port"))
+	}
+	return nil, fmt.Errorf("unsupported listener scheme %q", u.Scheme)
+}
+
+// listenTCP listens on a TCP address, serving TLS if a certificate is given.
+// minTLS is the minimum TLS version, 1.2 by default.
+func listenTCP(addr, certFile, keyFile, minTLS string) (net.Listener, error) {
+	var config *tls.Config
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config = &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+		switch minTLS {
+		case "", "1.2":
+		case "1.3":
+			config.MinVersion = tls.VersionTLS13
+		default:
+			return nil, fmt.Errorf("unsupported minimum TLS version %q", minTLS)
+		}
+	}
+
+	l, err := takeListener("tcp", addr, func() (net.Listener, error) { return net.Listen("tcp", addr) })
+	if err != nil {
+		return nil, err
+	}
+	// The PROXY header comes before the TLS handshake.
+	l = withProxyProtocol(l)
+	if config != nil {
+		tlsEnabled = true
+		return tls.NewListener(l, config), nil
+	}
+	return l, nil
+}
+
+// parseMode parses octal file permissions, 0660 by default.
+func parseMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0660, nil
+	}
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return 0, err
+	}
+	return os.FileMode(m), nil
+}
+
+// activatedListeners returns the listeners passed by systemd socket
+// activation through LISTEN_PID and LISTEN_FDS, if any, or handed over by a
+// previous process that was activated.
+func activatedListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return inheritedActivatedListeners(), nil
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return inheritedActivatedListeners(), nil
+	}
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	listeners := make([]net.Listener, 0, n)
+	for fd := listenFdsStart; fd < listenFdsStart+n; fd++ {
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		openListeners = append(openListeners, namedListener{"activated:" + strconv.Itoa(fd-listenFdsStart), l})
+		listeners = append(listeners, withProxyProtocol(l))
+	}
+	return listeners, nil
+}
+
+// listenUnix listens on a Unix domain socket at path with the given
+// permissions, replacing a stale socket left by a previous run.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if l, ok := inheritedListeners["unix:"+path]; ok {
+		delete(inheritedListeners, "unix:"+path)
+		openListeners = append(openListeners, namedListener{"unix:" + path, l})
+		return withProxyProtocol(l), nil
+	}
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	openListeners = append(openListeners, namedListener{"unix:" + path, l})
+	return withProxyProtocol(l), nil
+}
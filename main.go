@@ -3,32 +3,135 @@ package main
 import (
 	"bufio"
 	"context"
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
 	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"math/big"
 	"math/rand"
+	"mime"
+	"net"
 	"net/http"
+	"net/http/httputil"
+	"net/mail"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
-	"syscall"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Http client that connects.
 type client struct {
-	fileName          string
-	clientConnected   chan bool
-	downloadCompleted chan bool
-	receiving         bool
-	receiver          *http.ResponseWriter
+	fileName        string
+	contentType     string
+	size            int64 // -1 when unknown.
+	created         time.Time
+	expires         time.Time
+	startedAt       time.Time // When the transfer started streaming.
+	clientConnected chan bool
+	receiver        *receiver    // Client the file is streamed to.
+	queue           []*receiver  // Clients waiting to take over if the receiver leaves early.
+	transferred     atomic.Int64 // Bytes relayed to the receiver so far.
+	status          *uploadStatus
+	conn            net.Conn // Hijacked uploader connection.
+	spool           *spool   // Buffers the file for parallel downloads, if enabled.
+	archive         *archive // Copy of the file retained in ARCHIVE_DIR, if requested.
+
+	// Closed when the transfer is aborted, with the reason in abortErr.
+	aborted   chan struct{}
+	abortErr  error
+	abortOnce sync.Once
+
+	// Confirmation code the receiver must present, if any, and the uploader's approval.
+	code         string
+	codeAttempts int
+	approved     chan bool
+
+	// Code of the short link redirecting to the download link, if any.
+	shortCode string
+
+	// Whether browsers should display the file instead of saving it, unless
+	// the receiver asks otherwise.
+	inline bool
+
+	// Message from the uploader shown to the receiver, if any.
+	note string
+
+	// Whether the transfer is listed on the browse page.
+	public bool
+
+	// Connections resuming the upload after it broke, and the one in use.
+	resumes    chan *resumption
+	resumption *resumption
+
+	// Receivers reconnecting after the download broke, the secret they
+	// present, and the last bytes relayed that they may have missed.
+	reconnects  chan *receiver
+	resumeToken string
+	rewind      *rewindBuffer
+
+	// WebRTC signaling messages for the uploader and the receiver.
+	signals [2]chan json.RawMessage
+
+	subscribersMutex sync.Mutex
+	subscribers      map[chan statusEvent]struct{}
+	lastEvent        statusEvent
+}
+
+// Http client that receives a file.
+type receiver struct {
+	w         http.ResponseWriter
+	conn      net.Conn // Connection of w, if not shared with other requests.
+	ip        string
+	agent     string
+	inline    bool          // Whether the file is displayed in the browser instead of saved.
+	offset    int64         // Position in the file a reconnecting client continues from.
+	joinToken string        // Secret further connections of the client present to read a spooled transfer.
+	mu        sync.Mutex    // Guards writes to w before the transfer starts.
+	started   bool          // Whether the transfer started streaming to this client. Set holding clientsRWMutex and mu.
+	moved     chan struct{} // Signals a change of queue position.
+	done      chan error    // Result of the transfer.
+}
+
+// statusError is an error reported to a client with an HTTP status code.
+type statusError struct {
+	code    int
+	message string
+}
+
+func (e *statusError) Error() string {
+	return e.message
+}
+
+var errTransferEnded = &statusError{http.StatusGone, "The upload ended before the transfer started."}
+var errNotApproved = &statusError{http.StatusForbidden, "The transfer was not approved."}
+var errShuttingDown = &statusError{http.StatusServiceUnavailable, "Server is shutting down."}
+var errShutDown = &statusError{http.StatusServiceUnavailable, "Server shut down before the transfer completed."}
+var errCanceled = &statusError{http.StatusGone, "The transfer was canceled by the uploader."}
+var errAlreadyReceived = &statusError{http.StatusGone, "File already received by another client."}
+
+// receiverDisconnected reports a receiver that left after n bytes.
+func receiverDisconnected(n int64) error {
+	return &statusError{http.StatusGone, fmt.Sprintf("The receiver disconnected after %s.", formatBytes(n))}
 }
 
 // Url where this service is hosted where clients will download the files (e.g., https://mydomain.com/streamer)
 // For localhost, use http://localhost:3000 where 3000 is the local http listenter port.
-var downloadBaseUrl = os.Getenv("DOWNLOAD_BASE_URL") // e.g., https://mydomain.com/streamer
+// When empty, it is derived from each upload request.
+var downloadBaseUrl = strings.TrimSuffix(os.Getenv("DOWNLOAD_BASE_URL"), "/") // e.g., https://mydomain.com/streamer
 
 // Local http listener port
 var port = os.Getenv("PORT")
@@ -39,6 +142,18 @@ var validPassword = os.Getenv("USER_PASSWORD")
 // Route prefix
 const prefix = "streamer"
 
+// How long an upload waits for a client to connect by default (e.g., 120s).
+var waitTimeout time.Duration
+
+// Upper limit for the wait time requested by an upload.
+var maxWaitTimeout time.Duration
+
+// How often a heartbeat is written to idle connections so proxies don't drop them (e.g., 30s). Zero disables heartbeats.
+var heartbeatInterval time.Duration
+
+// How often progress is reported to the uploader during a transfer (e.g., 10s). Zero disables progress reports.
+var progressInterval time.Duration
+
 const bufferSize = 1 << 15 // 32 KiB buffer.
 var bufPool = sync.Pool{
 	New: func() interface{} {
@@ -47,196 +162,1257 @@ var bufPool = sync.Pool{
 	},
 }
 
-func main() {
-	startTime := time.Now()
+// Pending and active transfers keyed by file ID.
+var clients = make(map[string]*client)
+var clientsRWMutex = sync.RWMutex{}
 
-	if downloadBaseUrl == "" {
-		log.Panic("DOWNLOAD_BASE_URL is empty")
-	}
-	if validUserName == "" {
-		log.Panic("USER_NAME is empty")
-	}
+func handle(w http.ResponseWriter, r *http.Request) {
 
-	if validPassword == "" {
-		log.Panic("USER_PASSWORD is empty")
+	// Extract file name from URL
+	path := r.URL.EscapedPath()
+	index := strings.LastIndex(path, "/"+prefix+"/")
+	if index < 0 {
+		notFound(w, r)
+		return
 	}
 
-	if port == "" {
-		port = "3000"
+	// The path is split before it is unescaped, so an escaped slash stays in
+	// the file name.
+	segments := strings.Split(path[index+len(prefix)+2:], "/")
+	for i, segment := range segments {
+		name, err := url.PathUnescape(segment)
+		if err != nil {
+			http.Error(w, "Invalid file name", http.StatusBadRequest)
+			return
+		}
+		segments[i] = name
 	}
+	fileName, action := segments[0], strings.Join(segments[1:], "/")
 
-	clients := make(map[string]*client)
-	clientsRWMutex := sync.RWMutex{}
+	if r.Method == "POST" || r.Method == "PUT" {
+		if len(segments) > 1 {
+			fileID := fileName
+			switch {
+			case action == "approve" && r.Method == "POST":
+				withWriteTimeout(w, r, func(w http.ResponseWriter, r *http.Request) { approve(w, r, fileID) })
+			case action == "resume":
+				resume(w, r, fileID)
+			case action == "signal" && r.Method == "POST":
+				withWriteTimeout(w, r, func(w http.ResponseWriter, r *http.Request) { signaling(w, r, fileID) })
+			case strings.HasPrefix(action, "segments/") && r.Method == "POST":
+				segment(w, r, fileID, strings.TrimPrefix(action, "segments/"))
+			default:
+				notFound(w, r)
+			}
+			return
+		}
+		if r.Method == "POST" && r.URL.Query().Has("preflight") {
+			withWriteTimeout(w, r, func(w http.ResponseWriter, r *http.Request) { preflight(w, r, fileName) })
+			return
+		}
+		upload(w, r, fileName)
+	} else if r.Method == "GET" || r.Method == "HEAD" {
+		// Name here is the file ID, optionally followed by an action.
+		fileID := fileName
+		switch {
+		case fileID == "version" && action == "" && r.Method == "GET":
+			withWriteTimeout(w, r, versionHandler)
+		case fileID == "mine" && action == "" && r.Method == "GET":
+			withWriteTimeout(w, r, func(w http.ResponseWriter, r *http.Request) { mine(w, r) })
+		case fileID == "browse" && action == "" && r.Method == "GET":
+			withWriteTimeout(w, r, browse)
+		case fileID == "sign" && action == "" && r.Method == "GET":
+			withWriteTimeout(w, r, sign)
+		case action == "":
+			download(w, r, fileID, false)
+		case action == "segments" && r.Method == "GET":
+			download(w, r, fileID, true)
+		case strings.HasPrefix(action, "segments/"):
+			segment(w, r, fileID, strings.TrimPrefix(action, "segments/"))
+		case action == "meta" && r.Method == "GET":
+			withWriteTimeout(w, r, func(w http.ResponseWriter, r *http.Request) { meta(w, r, fileID) })
+		case action == "events" && r.Method == "GET":
+			events(w, r, fileID)
+		case action == "signal" && r.Method == "GET":
+			signaling(w, r, fileID)
+		default:
+			notFound(w, r)
+		}
+	} else if r.Method == "DELETE" && len(segments) == 1 {
+		withWriteTimeout(w, r, func(w http.ResponseWriter, r *http.Request) { cancel(w, r, fileName) })
+	} else {
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT, DELETE")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// authenticate reports whether r has the uploader's credentials, and records
+// the attempt in the audit log.
+func authenticate(r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if !ok || user != validUserName || pass != validPassword {
+		audit(r, "auth_failure", "", "", "")
+		return false
+	}
+	audit(r, "auth_success", "", "", "")
+	return true
+}
 
-		// Extract file name from URL
-		url := r.URL.String()
-		index := strings.LastIndex(url, "/"+prefix+"/")
-		if index < 0 {
-			http.NotFound(w, r)
+// upload registers a new transfer and streams the request body to the client
+// that connects to its download link.
+func upload(w http.ResponseWriter, r *http.Request, name string) {
+	fileName := sanitizeFileName(name)
+	signed := r.URL.Query().Has("sig")
+	// Whether the CAPTCHA token is left to the form fields before the file.
+	formCaptcha := false
+	if signed {
+		// Uploads to signed URLs need no credentials, but may have to pass a
+		// CAPTCHA challenge instead.
+		if captchaRequired() {
+			if token := r.Header.Get(captchaHeader); token != "" || formBoundary(r) == "" {
+				if err := verifyCaptcha(r, token); err != nil {
+					audit(r, "captcha_failure", "", fileName, err.Error())
+					http.Error(w, err.Error(), http.StatusForbidden)
+					return
+				}
+			} else {
+				formCaptcha = true
+			}
+		}
+		// The signed URL is only used up once the upload was accepted.
+		if err := verifySignedUpload(r, name); err != nil {
+			audit(r, "auth_failure", "", fileName, err.Error())
+			http.Error(w, err.Error(), http.StatusForbidden)
 			return
 		}
+	} else if !authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="streamer"`)
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
 
-		fileName := url[index+len(prefix)+2:]
+	if draining.Load() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
 
-		if r.Method == "POST" {
-			// Upload
+	options, err := parseUploadOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-			user, pass, ok := r.BasicAuth()
-			if !ok || user != validUserName || pass != validPassword {
-				http.Error(w, "Invalid Credentials", http.StatusUnauthorized)
-				return
-			}
+	// Generate a unique file ID
+	b := make([]byte, 36)
+	source := rand.NewSource(time.Now().UnixNano())
+	rng := rand.New(source)
+	n, err := rng.Read(b)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	encodedLength := base64.StdEncoding.EncodedLen(n)
+	buffer := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buffer)
+	base64.URLEncoding.Encode(*buffer, b)
 
-			// Generate a unique file ID
-			b := make([]byte, 36)
-			source := rand.NewSource(time.Now().UnixNano())
-			rng := rand.New(source)
-			n, err := rng.Read(b)
-			if err != nil {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte(err.Error()))
-				return
-			}
-			encodedLength := base64.StdEncoding.EncodedLen(n)
-			buffer := bufPool.Get().(*[]byte)
-			defer bufPool.Put(buffer)
-			base64.URLEncoding.Encode(*buffer, b)
+	fileID := string((*buffer)[:encodedLength])
+	if options.id != "" {
+		// The uploader chose the ID so the receiver can connect first.
+		fileID = options.id
+	}
 
-			fileID := string((*buffer)[:encodedLength])
+	// If client name already exists, error.
+	clientsRWMutex.RLock()
+	_, ok := clients[fileID]
+	clientsRWMutex.RUnlock()
 
-			// If client name already exists, error.
-			clientsRWMutex.RLock()
-			_, ok = clients[fileID]
-			clientsRWMutex.RUnlock()
+	if ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("File already exists. Choose a different name."))
+		return
+	}
 
-			if ok {
-				w.WriteHeader(http.StatusBadRequest)
-				w.Write([]byte("File already exists. Choose a different name."))
-				return
-			}
+	// NOTE: Cannot do Flush() since Go closes the request body and we get an error (http: invalid Read on closed Body).
+	// The alternative is to hijack the http connection or use HTTP2 with TLS (h2c requires draining the full request body upfront).
+	// The connection is hijacked before the client is registered, so events
+	// published to it always have somewhere to go.
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	setKeepAlive(conn)
+	status := &uploadStatus{
+		w:    &responseLogWriter{body: bufrw.Writer, header: w.Header()},
+		json: acceptsJSON(r),
+	}
+
+	// The request was accepted so far, so the body is needed now. Rejections
+	// above are sent before the uploader starts pushing it.
+	if r.ProtoAtLeast(1, 1) && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		status.writeContinue()
+	}
 
-			// Create a new client.
-			clientsRWMutex.Lock()
-			receiverCh := make(chan bool)
-			newClient := &client{
-				clientConnected: receiverCh,
-				fileName:        fileName,
+	// The body of the hijacked connection is read as is, so a chunked body of
+	// unknown size (e.g., from curl -T -) is decoded here.
+	var body io.Reader = io.LimitReader(bufrw, r.ContentLength)
+	if r.ContentLength < 0 {
+		body = httputil.NewChunkedReader(bufrw)
+	}
+	contentType, size := uploadContentType(r.Header.Get("Content-Type"), fileName), r.ContentLength
+	// A form upload carries the file in a part of the body, along with its
+	// name and type.
+	if boundary := formBoundary(r); boundary != "" {
+		part, fields, err := formFile(body, boundary)
+		if err != nil {
+			status.reject(http.StatusBadRequest, err.Error())
+			return
+		}
+		if formCaptcha {
+			if err := verifyCaptcha(r, fields.Get(captchaField())); err != nil {
+				audit(r, "captcha_failure", "", fileName, err.Error())
+				status.reject(http.StatusForbidden, err.Error())
+				return
 			}
-			clients[fileID] = newClient
+		}
+		body = part
+		if name == "" {
+			fileName = sanitizeFileName(part.FileName())
+		}
+		contentType, size = uploadContentType(part.Header.Get("Content-Type"), fileName), -1
+	}
+	if signed {
+		if err := useSignedUpload(r); err != nil {
+			audit(r, "auth_failure", "", fileName, err.Error())
+			status.reject(http.StatusForbidden, err.Error())
+			return
+		}
+		audit(r, "signed_upload", "", fileName, "")
+	}
 
-			defer func() {
-				// Remove client.
-				clientsRWMutex.Lock()
-				delete(clients, fileID)
-				clientsRWMutex.Unlock()
-			}()
+	// Create a new client.
+	clientsRWMutex.Lock()
+	receiverCh := make(chan bool, 1)
+	now := time.Now()
+	newClient := &client{
+		aborted:         make(chan struct{}),
+		clientConnected: receiverCh,
+		fileName:        fileName,
+		contentType:     contentType,
+		size:            size,
+		created:         now,
+		expires:         now.Add(options.wait),
+		inline:          options.inline,
+		note:            options.note,
+		public:          options.public,
+		conn:            conn,
+		status:          status,
+	}
+	if options.confirm {
+		newClient.code = confirmationCode()
+		newClient.approved = make(chan bool, 1)
+	}
+	for role := range newClient.signals {
+		newClient.signals[role] = make(chan json.RawMessage, signalQueueSize)
+	}
+	if resumeTimeout > 0 {
+		newClient.resumes = make(chan *resumption)
+	}
+	if downloadResumeTimeout > 0 && !options.parallel {
+		// Spooled transfers are downloaded in ranges instead.
+		newClient.reconnects = make(chan *receiver)
+		newClient.resumeToken = newReceiverToken()
+	}
+	if options.parallel {
+		var size int64
+		if options.segmented {
+			size = int64(segmentSize)
+		}
+		sp, err := newSpool(r.ContentLength, size, options.digest)
+		if err != nil {
 			clientsRWMutex.Unlock()
+			status.reject(http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer sp.close()
+		newClient.spool = sp
+	}
+	if options.archive {
+		ar, err := newArchive()
+		if err != nil {
+			clientsRWMutex.Unlock()
+			log.Printf("Error creating archive. %s", err)
+			status.reject(http.StatusInternalServerError, errArchiveFailed.Error())
+			return
+		}
+		defer ar.close()
+		newClient.archive = ar
+	}
+	if draining.Load() {
+		clientsRWMutex.Unlock()
+		status.reject(http.StatusServiceUnavailable, errShuttingDown.Error())
+		return
+	}
+	if _, ok := clients[fileID]; ok {
+		clientsRWMutex.Unlock()
+		status.reject(http.StatusBadRequest, "File already exists. Choose a different name.")
+		return
+	}
+	if shortLinkLength > 0 {
+		code, err := newShortCode()
+		if err != nil {
+			clientsRWMutex.Unlock()
+			status.reject(http.StatusServiceUnavailable, err.Error())
+			return
+		}
+		newClient.shortCode = code
+		shortLinks[code] = fileID
+	}
+	clients[fileID] = newClient
+	transfers.Add(1)
+	audit(r, "link_created", fileID, fileName, "")
 
-			// NOTE: Cannot do Flush() since Go closes the request body and we get an error (http: invalid Read on closed Body).
-			// The alternative is to hijack the http connection or use HTTP2 with TLS (h2c requires draining the full request body upfront).
-			hj, ok := w.(http.Hijacker)
-			if !ok {
-				http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
-				return
+	// Result reported to the receiver, if any.
+	var result error = errTransferEnded
+	defer func() {
+		// Remove client.
+		clientsRWMutex.Lock()
+		delete(clients, fileID)
+		delete(shortLinks, newClient.shortCode)
+		rc, queue := newClient.receiver, newClient.queue
+		clientsRWMutex.Unlock()
+		newClient.closeSubscribers()
+		transfers.Done()
+		if result != nil && newClient.abortError() != nil {
+			result = newClient.abortError()
+		}
+		if rc != nil {
+			rc.done <- result
+		}
+		for _, queued := range queue {
+			if result == nil {
+				queued.done <- errAlreadyReceived
+			} else {
+				queued.done <- errTransferEnded
 			}
-			conn, bufrw, err := hj.Hijack()
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		if newClient.resumption != nil {
+			newClient.resumption.result <- result
+		}
+	}()
+	clientsRWMutex.Unlock()
+
+	downloadUrl := fmt.Sprintf("%s/%s/%s", baseURL(r), prefix, fileID)
+	waiting := statusEvent{
+		Event:       "waiting",
+		Message:     fmt.Sprintf("To download the file, curl -o %s %s", shellQuote(fileName), downloadUrl),
+		ID:          fileID,
+		DownloadURL: downloadUrl,
+		Expires:     &newClient.expires,
+	}
+	if newClient.shortCode != "" {
+		waiting.ShortURL = baseURL(r) + shortLinkPrefix + newClient.shortCode
+		waiting.Message += fmt.Sprintf("\nShort link: %s", waiting.ShortURL)
+	}
+	status.writeHeader(http.StatusOK)
+	newClient.emit(waiting)
+	if newClient.code != "" {
+		// Only the uploader may learn the code, so it is not published.
+		status.send(statusEvent{
+			Event:   "code",
+			Message: fmt.Sprintf("Confirmation code: %s. Share it with the recipient separately; they must add ?code=%s to the link.", newClient.code, newClient.code),
+			Code:    newClient.code,
+		})
+	}
+	// A receiver waiting for the ID is only let in once the uploader was told
+	// about the transfer.
+	clientsRWMutex.Lock()
+	arrived(fileID)
+	clientsRWMutex.Unlock()
+
+	if len(options.emails) > 0 {
+		go func() {
+			if err := sendLinkEmail(newClient, options.emails, downloadUrl); err != nil {
+				newClient.emit(statusEvent{Event: "email_failed", Message: fmt.Sprintf("The link could not be emailed. %s", err)})
 				return
 			}
-			defer conn.Close()
-			w = &responseLogWriter{body: bufrw.Writer, header: make(http.Header)}
-			w.Write([]byte(fmt.Sprintf("HTTP/1.1 200 OK\r\n\r\nTo download the file, curl -o %s %s/%s/%s\n", fileName, downloadBaseUrl, prefix, fileID)))
-			bufrw.Flush()
+			newClient.emit(statusEvent{Event: "email_sent", Message: fmt.Sprintf("The link was emailed to %s.", strings.Join(options.emails, ", "))})
+		}()
+	}
 
-			// Wait for a client to stream the file to.
-			select {
-			case <-receiverCh:
-				w.Write([]byte("Client connected.\n"))
-				bufrw.Writer.Flush()
+	// Wait for a client to stream the file to.
+	var rc *receiver
+	for rc == nil {
+		switch newClient.await(r, receiverCh, time.Until(newClient.expires), "Waiting for a client to connect...") {
+		case awaitReady:
+		case awaitTimeout:
+			newClient.emit(statusEvent{Event: "timeout", Message: errorMessage("timeout", fmt.Sprintf("Timed out. No client connected in %d seconds.", options.wait/time.Second), fileName)})
+			return
+		default:
+			return
+		}
+		clientsRWMutex.RLock()
+		rc = newClient.receiver
+		clientsRWMutex.RUnlock()
+		if rc == nil {
+			// The client left before the transfer started.
+			continue
+		}
+		newClient.emit(connectedEvent(rc))
+		go newClient.reportHostname(rc)
 
-			case <-r.Context().Done():
-				w.Write([]byte("Request disconnected.\n"))
-				bufrw.Writer.Flush()
+		if newClient.approved != nil {
+			// Discard a stale signal about a previous client.
+			select {
+			case <-newClient.approved:
+			default:
+			}
+			newClient.emit(statusEvent{
+				Event:   "approval",
+				Message: fmt.Sprintf("The client presented the confirmation code. To start the transfer, curl -X POST -u \"user:password\" %s/approve", downloadUrl),
+			})
+			switch newClient.await(r, newClient.approved, options.wait, "Waiting for approval...") {
+			case awaitReady:
+			case awaitTimeout:
+				result = errNotApproved
+				newClient.emit(statusEvent{Event: "timeout", Message: errorMessage("timeout", fmt.Sprintf("Timed out. The transfer was not approved in %d seconds.", options.wait/time.Second), fileName)})
 				return
-
-			case <-time.After(120 * time.Second):
-				w.Write([]byte("Timed out. No client connected in 120 seconds.\n"))
-				bufrw.Writer.Flush()
+			default:
 				return
 			}
+		}
 
-			defer func() {
-				newClient.downloadCompleted <- true
-			}()
+		// Start streaming unless the client left in the meantime.
+		clientsRWMutex.Lock()
+		if newClient.receiver == rc {
+			rc.start()
+		} else {
+			rc = nil
+		}
+		clientsRWMutex.Unlock()
+		if rc != nil && newClient.approved != nil {
+			newClient.emit(statusEvent{Event: "approved", Message: "Transfer approved."})
+		}
+	}
 
-			// Copy the request body to client
-			(*newClient.receiver).Header().Add("content-disposition", "attachment; filename=\""+fileName+"\"")
-			_, err = io.CopyBuffer(*newClient.receiver, io.LimitReader(bufrw, r.ContentLength), *buffer)
-			if err != nil {
-				w.Write([]byte(err.Error()))
-				bufrw.Writer.Flush()
-				return
+	// Copy the request body to client
+	newClient.startedAt = time.Now()
+	stopProgress := make(chan struct{})
+	go reportProgress(newClient, stopProgress)
+	if newClient.reconnects != nil {
+		newClient.rewind = &rewindBuffer{buf: make([]byte, rewindBufferSize)}
+	}
+	err = newClient.relay(body, *buffer)
+	close(stopProgress)
+	if err == nil && newClient.archive != nil {
+		// The whole file was relayed, even if the client is still downloading
+		// it from the spool.
+		name, archiveErr := newClient.archive.keep(newClient.fileName, newClient.startedAt)
+		if archiveErr != nil {
+			log.Printf("Error archiving %s. %s", newClient.fileName, archiveErr)
+			newClient.emit(statusEvent{Event: "archive_failed", Message: errArchiveFailed.Error()})
+		} else {
+			audit(r, "archived", fileID, fileName, name)
+			newClient.emit(statusEvent{Event: "archived", Message: fmt.Sprintf("A copy was archived as %s.", name)})
+		}
+	}
+	if err == nil && newClient.spool != nil {
+		// The client may still be downloading from the spool.
+		switch newClient.awaitDownloads(r, options.wait) {
+		case awaitReady:
+		case awaitTimeout:
+			err = errDownloadIncomplete
+		default:
+			return
+		}
+	}
+	if err != nil {
+		result = err
+		newClient.emit(statusEvent{Event: "error", Message: err.Error()})
+		return
+	}
+
+	result = nil
+	newClient.emit(newClient.doneEvent())
+}
+
+// Outcomes of waiting on the uploader's behalf.
+const (
+	awaitReady = iota
+	awaitTimeout
+	awaitDisconnected
+	awaitAborted
+)
+
+// await waits until ready receives, sending heartbeats to the uploader in the
+// meantime.
+func (c *client) await(r *http.Request, ready <-chan bool, timeout time.Duration, waiting string) int {
+	heartbeat := newHeartbeat()
+	defer heartbeat.Stop()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ready:
+			return awaitReady
+
+		case <-heartbeat.C:
+			// A failed write means the uploader is gone.
+			if c.status.send(statusEvent{Event: "heartbeat", Message: waiting}) != nil {
+				c.publish(statusEvent{Event: "error", Message: "Request disconnected."})
+				return awaitDisconnected
 			}
 
-			w.Write([]byte(fmt.Sprintf("%s was transferred successfully.\n", fileName)))
-			bufrw.Writer.Flush()
-		} else if r.Method == "GET" {
+		case <-r.Context().Done():
+			c.emit(statusEvent{Event: "error", Message: "Request disconnected."})
+			return awaitDisconnected
+
+		case <-c.aborted:
+			c.emit(statusEvent{Event: "error", Message: c.abortErr.Error()})
+			return awaitAborted
+
+		case <-timer.C:
+			return awaitTimeout
+		}
+	}
+}
+
+// download claims a transfer and waits for the uploader to stream it. For a
+// segmented transfer, the client can claim it for the segment manifest
+// instead of the file.
+func download(w http.ResponseWriter, r *http.Request, fileID string, manifest bool) {
+	// If client does not exist error.
+	clientsRWMutex.RLock()
+	client, ok := clients[fileID]
+	clientsRWMutex.RUnlock()
+	if !ok && !manifest {
+		// The receiver may connect before the uploader.
+		client, ok = awaitUpload(r, fileID)
+	}
+	if !ok || manifest && (client.spool == nil || client.spool.segmentSize == 0) {
+		notFound(w, r)
+		return
+	}
+	if token := r.URL.Query().Get("resume"); token != "" && !manifest && r.Method == "GET" {
+		reconnectDownload(w, r, fileID, client, token)
+		return
+	}
+	ip := clientIP(r)
+
+	// Further connections of the client downloading a spooled transfer read
+	// their range from the spool.
+	clientsRWMutex.RLock()
+	receiving := client.receiver != nil
+	joining := client.joinedBy(r)
+	clientsRWMutex.RUnlock()
+	if joining {
+		if manifest {
+			client.spool.serveManifest(w, client)
+		} else {
+			client.spool.serve(w, r, client)
+		}
+		return
+	}
+
+	if r.Method == "HEAD" {
+		// Describe the pending transfer without claiming it.
+		if receiving {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		setTransferHeaders(w.Header(), client, client.inlineFor(r))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
 
-			// If client does not exist error.
+	rc := &receiver{
+		w:      w,
+		conn:   requestConn(r),
+		ip:     ip,
+		agent:  r.UserAgent(),
+		inline: client.inlineFor(r),
+		moved:  make(chan struct{}, 1),
+		done:   make(chan error, 1),
+	}
+	if client.spool != nil {
+		rc.joinToken = newReceiverToken()
+	}
+
+	clientsRWMutex.Lock()
+	if client.receiver != nil && len(client.queue) >= downloadQueueSize {
+		clientsRWMutex.Unlock()
+		writeError(w, r, "busy", http.StatusBadRequest, "File already being received by another client.\n", client.fileName)
+		return
+	}
+	if client.code != "" {
+		if client.codeAttempts >= maxCodeAttempts {
+			clientsRWMutex.Unlock()
+			audit(r, "code_locked", fileID, client.fileName, "")
+			http.Error(w, "Too many invalid confirmation codes.\n", http.StatusForbidden)
+			return
+		}
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			code = r.Header.Get("X-Streamer-Code")
+		}
+		if subtle.ConstantTimeCompare([]byte(code), []byte(client.code)) != 1 {
+			client.codeAttempts++
+			clientsRWMutex.Unlock()
+			audit(r, "code_rejected", fileID, client.fileName, "")
+			client.emit(statusEvent{Event: "code_rejected", Message: fmt.Sprintf("A client from %s presented an invalid confirmation code.", rc.ip), IP: rc.ip})
+			http.Error(w, "Invalid confirmation code.\n", http.StatusForbidden)
+			return
+		}
+	}
+	position := 0
+	if client.receiver == nil {
+		client.receiver = rc
+	} else {
+		client.queue = append(client.queue, rc)
+		position = len(client.queue)
+	}
+	clientsRWMutex.Unlock()
+
+	audit(r, "link_claimed", fileID, client.fileName, fmt.Sprintf("queue position %d", position))
+	if position == 0 {
+		client.notifyConnected()
+	} else {
+		client.emit(statusEvent{Event: "queued", Message: fmt.Sprintf("A client from %s is queued at position %d.", rc.ip, position), IP: rc.ip, Position: position})
+		rc.sendPosition(position)
+	}
+
+	// Wait for transfer. Only the receiver reads the spool; other connections
+	// of its client join with its token.
+	var ready <-chan struct{}
+	if client.spool != nil && position == 0 {
+		ready = client.spool.ready
+	}
+	var err error
+wait:
+	for {
+		select {
+		case <-ready:
+			w.Header().Set("X-Streamer-Join-Token", rc.joinToken)
+			if manifest {
+				client.spool.serveManifest(w, client)
+			} else {
+				client.spool.serve(w, r, client)
+			}
+			return
+
+		case <-rc.moved:
 			clientsRWMutex.RLock()
-			client, ok := clients[fileName] // Name here is the file ID.
+			position := client.position(rc)
 			clientsRWMutex.RUnlock()
-			if ok {
-				if !client.receiving {
-					clientsRWMutex.Lock()
-					client.receiver = &w
-					client.receiving = true
-					client.downloadCompleted = make(chan bool)
-					clientsRWMutex.Unlock()
-					client.clientConnected <- true
-				} else {
-					http.Error(w, "File already being received by another client.\n", http.StatusBadRequest)
-					return
-				}
-			} else {
-				http.NotFound(w, r)
+			rc.sendPosition(position)
+
+		case <-r.Context().Done():
+			if client.leave(rc) {
+				client.emit(statusEvent{Event: "left", Message: fmt.Sprintf("The client from %s disconnected before the transfer started.", rc.ip), IP: rc.ip})
 				return
 			}
-			// Wait for transfer.
-			<-client.downloadCompleted
+			if ready != nil {
+				// The spool is read by this handler, not the transfer.
+				return
+			}
+			// The transfer owns the response. Once data was sent, stop it rather
+			// than wait for the next write to fail, so the uploader learns at
+			// once, unless the client may reconnect. Before that, the relay
+			// hands it over to a queued client.
+			if n := client.transferred.Load(); n > 0 && client.reconnects == nil {
+				clientsRWMutex.Lock()
+				client.abort(receiverDisconnected(n))
+				clientsRWMutex.Unlock()
+			}
+			err = <-rc.done
+			break wait
+
+		case err = <-rc.done:
+			break wait
+		}
+	}
+	finishDownload(w, r, client, rc, err)
+}
+
+// finishDownload completes the response of rc once the transfer ended with
+// err.
+func finishDownload(w http.ResponseWriter, r *http.Request, client *client, rc *receiver, err error) {
+	if err == nil {
+		setStatsTrailers(w.Header(), client)
+		return
+	}
+	if rc.started {
+		// Part of the file was sent. Break the connection so the client can't
+		// mistake it for the whole file.
+		panic(http.ErrAbortHandler)
+	}
+	code := http.StatusInternalServerError
+	if se, ok := err.(*statusError); ok {
+		code = se.code
+	}
+	if code == http.StatusGatewayTimeout {
+		writeError(w, r, "timeout", code, err.Error()+"\n", client.fileName)
+		return
+	}
+	http.Error(w, err.Error()+"\n", code)
+}
+
+// approve lets the uploader start a transfer that requires confirmation.
+func approve(w http.ResponseWriter, r *http.Request, fileID string) {
+	if !authenticate(r) {
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	clientsRWMutex.RLock()
+	client, ok := clients[fileID]
+	var receiving bool
+	if ok {
+		receiving = client.receiver != nil
+	}
+	clientsRWMutex.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if client.approved == nil {
+		http.Error(w, "The transfer does not require approval.\n", http.StatusBadRequest)
+		return
+	}
+	if !receiving {
+		http.Error(w, "No client is waiting for approval.\n", http.StatusConflict)
+		return
+	}
+
+	select {
+	case client.approved <- true:
+	default:
+	}
+	audit(r, "transfer_approved", fileID, client.fileName, "")
+	w.Write([]byte("Transfer approved.\n"))
+}
+
+// cancel lets the uploader abort a pending or active transfer.
+func cancel(w http.ResponseWriter, r *http.Request, fileID string) {
+	if !authenticate(r) {
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	clientsRWMutex.Lock()
+	client, ok := clients[fileID]
+	if ok {
+		client.abort(errCanceled)
+	}
+	clientsRWMutex.Unlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	audit(r, "transfer_canceled", fileID, client.fileName, "")
+	w.Write([]byte("Transfer canceled.\n"))
+}
+
+// transferMeta is the JSON description of a pending transfer.
+type transferMeta struct {
+	Name               string    `json:"name"`
+	Size               *int64    `json:"size"`
+	ContentType        string    `json:"content_type"`
+	Created            time.Time `json:"created"`
+	Expires            time.Time `json:"expires"`
+	TTL                int64     `json:"ttl"` // Remaining seconds to connect.
+	DownloadsRemaining int       `json:"downloads_remaining"`
+	Queued             int       `json:"queued"` // Clients waiting to take over the download.
+	Note               string    `json:"note,omitempty"`
+}
+
+// meta describes a transfer as JSON without claiming it.
+func meta(w http.ResponseWriter, r *http.Request, fileID string) {
+	clientsRWMutex.RLock()
+	client, ok := clients[fileID]
+	var m transferMeta
+	if ok {
+		m = client.meta()
+	}
+	clientsRWMutex.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(m)
+}
+
+// meta returns the description of c. clientsRWMutex must be held.
+func (c *client) meta() transferMeta {
+	m := transferMeta{
+		Name:               c.fileName,
+		ContentType:        c.contentType,
+		Created:            c.created.UTC(),
+		Expires:            c.expires.UTC(),
+		DownloadsRemaining: 1,
+		Note:               c.note,
+	}
+	if c.size >= 0 {
+		size := c.size
+		m.Size = &size
+	}
+	m.Queued = len(c.queue)
+	if c.receiver != nil {
+		m.DownloadsRemaining = 0
+	} else if ttl := time.Until(c.expires); ttl > 0 {
+		m.TTL = int64(ttl / time.Second)
+	}
+	return m
+}
+
+// ownTransfer is the JSON description of a transfer for its uploader.
+type ownTransfer struct {
+	ID          string `json:"id"`
+	DownloadURL string `json:"download_url"`
+	ShortURL    string `json:"short_url,omitempty"`
+	State       string `json:"state"` // waiting, connected or active.
+	Bytes       int64  `json:"bytes"` // Bytes relayed so far.
+	transferMeta
+}
+
+// mine lists the transfers of the uploader so that a lost download link can
+// be recovered.
+func mine(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="streamer"`)
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	list := []ownTransfer{}
+	clientsRWMutex.RLock()
+	for fileID, client := range clients {
+		t := ownTransfer{
+			ID:           fileID,
+			DownloadURL:  fmt.Sprintf("%s/%s/%s", baseURL(r), prefix, fileID),
+			State:        "waiting",
+			Bytes:        client.transferred.Load(),
+			transferMeta: client.meta(),
+		}
+		if client.shortCode != "" {
+			t.ShortURL = baseURL(r) + shortLinkPrefix + client.shortCode
+		}
+		if rc := client.receiver; rc != nil && rc.started {
+			t.State = "active"
+		} else if rc != nil {
+			t.State = "connected"
+		}
+		list = append(list, t)
+	}
+	clientsRWMutex.RUnlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Created.Before(list[j].Created) })
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(list)
+}
+
+func main() {
+	startTime := time.Now()
+
+	selfTestMode := flag.Bool("selftest", false, "upload and download random data through the server on a loopback listener, report the latency and throughput, and exit")
+	selfTestSize := flag.Int64("selftest-size", 256<<20, "bytes transferred by -selftest")
+	flag.Parse()
+	if *selfTestMode && validUserName == "" && validPassword == "" {
+		// Only the self-test client can connect.
+		validUserName, validPassword = "selftest", "selftest"
+	}
+
+	if validUserName == "" {
+		log.Panic("USER_NAME is empty")
+	}
+
+	if validPassword == "" {
+		log.Panic("USER_PASSWORD is empty")
+	}
+
+	waitTimeout = durationFromEnv("WAIT_TIMEOUT", 120*time.Second)
+	maxWaitTimeout = durationFromEnv("MAX_WAIT_TIMEOUT", 24*time.Hour)
+	if waitTimeout == 0 || maxWaitTimeout == 0 {
+		log.Panic("WAIT_TIMEOUT and MAX_WAIT_TIMEOUT must be greater than zero")
+	}
+	if waitTimeout > maxWaitTimeout {
+		maxWaitTimeout = waitTimeout
+	}
+	progressInterval = durationFromEnv("PROGRESS_INTERVAL", 10*time.Second)
+	heartbeatInterval = durationFromEnv("HEARTBEAT_INTERVAL", 30*time.Second)
+	downloadQueueSize = intFromEnv("DOWNLOAD_QUEUE_SIZE", 4)
+	trustedProxies = parseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	drainTimeout = durationFromEnv("DRAIN_TIMEOUT", 60*time.Second)
+	handoffDrainTimeout = durationFromEnv("HANDOFF_DRAIN_TIMEOUT", 24*time.Hour)
+	writeTimeout = durationFromEnv("WRITE_TIMEOUT", 30*time.Second)
+	resumeTimeout = durationFromEnv("RESUME_TIMEOUT", 0)
+	rendezvousTimeout = durationFromEnv("RENDEZVOUS_TIMEOUT", 0)
+	downloadResumeTimeout = durationFromEnv("DOWNLOAD_RESUME_TIMEOUT", 0)
+	rewindBufferSize = intFromEnv("REWIND_BUFFER_SIZE", 8<<20)
+	if downloadResumeTimeout > 0 && rewindBufferSize == 0 {
+		log.Panic("REWIND_BUFFER_SIZE must be greater than zero")
+	}
+	maxSignedURLTTL = durationFromEnv("SIGNED_URL_MAX_TTL", 7*24*time.Hour)
+	initSigningKey()
+	checkCaptchaConfig()
+	uploadStallTimeout = durationFromEnv("UPLOAD_STALL_TIMEOUT", 0)
+	downloadStallTimeout = durationFromEnv("DOWNLOAD_STALL_TIMEOUT", 0)
+	if smtpHost != "" {
+		if _, err := mail.ParseAddress(smtpFrom); err != nil {
+			log.Panicf("SMTP_FROM is not a valid address: %q", smtpFrom)
 		}
-	})
+	}
+	shortLinkLength = intFromEnv("SHORT_LINK_LENGTH", 0)
+	if shortLinkLength > 0 && shortLinkLength < minShortLinkLength {
+		log.Panicf("SHORT_LINK_LENGTH must be at least %d", minShortLinkLength)
+	}
+	if shortLinkAlphabet == "" {
+		shortLinkAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+	}
+	if len([]rune(shortLinkAlphabet)) < 2 {
+		log.Panic("SHORT_LINK_ALPHABET must have at least two characters")
+	}
+	segmentSize = intFromEnv("SEGMENT_SIZE", 8<<20)
+	if segmentSize == 0 {
+		log.Panic("SEGMENT_SIZE must be greater than zero")
+	}
+	loadErrorTemplates()
+	openAuditLog()
 
+	if corsAllowedMethods == "" {
+		corsAllowedMethods = "GET, HEAD, POST, PUT, DELETE, OPTIONS"
+	}
+	if corsAllowedHeaders == "" {
+		corsAllowedHeaders = "Authorization, Content-Type, Accept"
+	}
+	checkCORSConfig()
+	hstsMaxAge = durationFromEnv("HSTS_MAX_AGE", 0)
+	if contentTypeOptions == "" {
+		contentTypeOptions = "nosniff"
+	}
+	if referrerPolicy == "" {
+		referrerPolicy = "no-referrer"
+	}
+
+	http.HandleFunc("/", secure(cors(handle)))
+	http.HandleFunc(shortLinkPrefix, secure(shortLink))
+
+	readHeaderTimeout := durationFromEnv("READ_HEADER_TIMEOUT", 10*time.Second)
 	server := &http.Server{
-		Addr: ":" + port,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       durationFromEnv("IDLE_TIMEOUT", 120*time.Second),
+		MaxHeaderBytes:    intFromEnv("MAX_HEADER_BYTES", http.DefaultMaxHeaderBytes),
+		ConnContext:       withConn,
+		// WriteTimeout would cut off streaming responses. See withWriteTimeout.
 	}
 
-	go func() {
-		// Service connections.
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Error listening on server. %s", err)
+	if *selfTestMode {
+		if err := selfTest(server, *selfTestSize); err != nil {
+			log.Fatalf("Self-test failed. %s", err)
 		}
-	}()
+		return
+	}
+
+	for _, l := range listen() {
+		go func(l net.Listener) {
+			// Service connections.
+			log.Printf("Listening on %s.\n", l.Addr())
+			if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+				log.Fatalf("Error listening on server. %s", err)
+			}
+		}(l)
+	}
+	redirectServer := serveRedirect(readHeaderTimeout)
+	closeUnusedListeners()
 	log.Printf("Server started after %d ms.\n", time.Since(startTime)/time.Millisecond)
 
-	// Wait for interrupt signal to gracefully shutdown the server with
-	// a timeout of 10 seconds.
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
-	<-quit
+	// Wait for interrupt signal to gracefully shutdown the server once
+	// in-flight transfers are drained. The handoff signal hands the listeners
+	// to a new process of the executable first, such as an upgraded binary.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, shutdownSignals...)
+	if handoffSignal != nil {
+		signal.Notify(quit, handoffSignal)
+	}
+	startService(quit)
+	defer serviceStopped()
+	timeout := drainTimeout
+	for sig := range quit {
+		if sig != handoffSignal {
+			break
+		}
+		if err := handoff(); err != nil {
+			log.Printf("Error handing off listeners. %s", err)
+			continue
+		}
+		log.Println("Handed off listeners to the new process.")
+		// Stop accepting connections, but let active transfers complete.
+		go server.Shutdown(context.Background())
+		if redirectServer != nil {
+			go redirectServer.Shutdown(context.Background())
+		}
+		timeout = handoffDrainTimeout
+		break
+	}
 	log.Println("Shutting down server...")
-	time.Sleep(3 * time.Second)
+	drain(timeout)
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
 		log.Printf("Error shutting down server. %s", err)
 	}
+	if redirectServer != nil {
+		redirectServer.Close()
+	}
 	log.Println("Server exiting...")
 }
 
+// Maximum number of clients waiting in line to take over a download.
+var downloadQueueSize int
+
+// Number of invalid confirmation codes accepted before a transfer refuses further attempts.
+const maxCodeAttempts = 5
+
+// confirmationCode returns a random six-digit code.
+func confirmationCode() string {
+	n, err := cryptorand.Int(cryptorand.Reader, big.NewInt(1000000))
+	if err != nil {
+		log.Panic(err)
+	}
+	return fmt.Sprintf("%06d", n)
+}
+
+// How long to wait for the reverse DNS lookup of a connecting client.
+const reverseLookupTimeout = 2 * time.Second
+
+// connectedEvent describes a client that connected to receive a file.
+func connectedEvent(rc *receiver) statusEvent {
+	ev := statusEvent{Event: "connected", IP: rc.ip, UserAgent: rc.agent}
+	ev.Message = "Client connected"
+	if ev.IP != "" {
+		ev.Message += " from " + ev.IP
+	}
+	if ev.UserAgent != "" {
+		ev.Message += " (" + ev.UserAgent + ")"
+	}
+	ev.Message += "."
+	return ev
+}
+
+// reportHostname looks up the reverse DNS name of the client that connected
+// to receive c and reports it to the uploader in a hostname event. It runs
+// alongside the transfer, so that a slow lookup doesn't delay it.
+func (c *client) reportHostname(rc *receiver) {
+	if rc.ip == "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+	defer cancel()
+	names, err := net.DefaultResolver.LookupAddr(ctx, rc.ip)
+	if err != nil || len(names) == 0 {
+		return
+	}
+	hostname := strings.TrimSuffix(names[0], ".")
+	c.emit(statusEvent{Event: "hostname", Message: fmt.Sprintf("The client from %s is %s.", rc.ip, hostname), IP: rc.ip, Hostname: hostname})
+}
+
+// Time limit for writing non-streaming responses (e.g., 30s). Zero disables the limit.
+var writeTimeout time.Duration
+
+// withWriteTimeout serves a non-streaming request, giving up on the
+// connection if reading its body and writing the response take longer than
+// writeTimeout. Streaming paths such as uploads, downloads and event streams
+// must not use it since they run for as long as a transfer.
+func withWriteTimeout(w http.ResponseWriter, r *http.Request, h http.HandlerFunc) {
+	if writeTimeout <= 0 {
+		h(w, r)
+		return
+	}
+	conn := requestConn(r)
+	if conn == nil {
+		// HTTP/2 streams share the connection, so only the handler is bounded.
+		http.TimeoutHandler(h, writeTimeout, "Timed out writing the response.\n").ServeHTTP(w, r)
+		return
+	}
+	conn.SetDeadline(time.Now().Add(writeTimeout))
+	// The server only resets the read deadline for the next request on the
+	// connection.
+	defer conn.SetWriteDeadline(time.Time{})
+	h(w, r)
+}
+
+// TCP keep-alive period for long-lived connections.
+const tcpKeepAlivePeriod = 30 * time.Second
+
+// newHeartbeat returns a ticker firing every heartbeatInterval, or a ticker
+// that never fires if heartbeats are disabled.
+func newHeartbeat() *time.Ticker {
+	if heartbeatInterval <= 0 {
+		ticker := time.NewTicker(time.Hour)
+		ticker.Stop()
+		return ticker
+	}
+	return time.NewTicker(heartbeatInterval)
+}
+
+// intFromEnv parses a non-negative integer from an environment variable,
+// returning def when it is not set.
+func intFromEnv(name string, def int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Panicf("%s is not a valid number: %q", name, value)
+	}
+	return n
+}
+
+// durationFromEnv parses a duration such as 30s or 5m from an environment
+// variable, returning def when it is not set.
+func durationFromEnv(name string, def time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil || d < 0 {
+		log.Panicf("%s is not a valid duration: %q", name, value)
+	}
+	return d
+}
+
+// setKeepAlive enables TCP keep-alive on a hijacked connection so that a dead
+// peer is detected while the connection is idle.
+func setKeepAlive(conn net.Conn) {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	if pc, ok := conn.(*proxyConn); ok {
+		conn = pc.Conn
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetKeepAlive(true)
+		tcpConn.SetKeepAlivePeriod(tcpKeepAlivePeriod)
+	}
+}
+
+// uploadContentType returns the content type declared by the uploader, falling
+// back to one derived from the file extension.
+func uploadContentType(contentType, fileName string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType != "application/x-www-form-urlencoded" && mediaType != "application/octet-stream" {
+		return contentType
+	}
+	if contentType = mime.TypeByExtension(filepath.Ext(fileName)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
+
+// setTransferHeaders describes a transfer in the response headers sent to a
+// client before the file itself.
+func setTransferHeaders(h http.Header, c *client, inline bool) {
+	if inline {
+		h.Set("Content-Disposition", contentDisposition("inline", c.fileName))
+		// Keep uploaded HTML and SVG from running scripts on this origin.
+		h.Set("Content-Security-Policy", "sandbox")
+	} else {
+		h.Set("Content-Disposition", contentDisposition("attachment", c.fileName))
+	}
+	h.Set("Content-Type", c.contentType)
+	if c.size >= 0 {
+		h.Set("Content-Length", strconv.FormatInt(c.size, 10))
+	}
+	if c.spool != nil {
+		h.Set("Accept-Ranges", "bytes")
+	}
+	h.Set("Cache-Control", "no-store")
+	h.Set("X-Streamer-Expires", c.expires.UTC().Format(http.TimeFormat))
+	if c.note != "" {
+		h.Set("X-Streamer-Note", mime.QEncoding.Encode("utf-8", c.note))
+	}
+}
+
+// inlineFor reports whether the file is displayed inline for the receiver of
+// r, which can override the uploader's choice with ?disposition.
+func (c *client) inlineFor(r *http.Request) bool {
+	if inline, err := parseDisposition(r.URL.Query().Get("disposition")); err == nil {
+		return inline
+	}
+	return c.inline
+}
+
+// sanitizeFileName strips path separators, control characters and invalid UTF-8
+// from an uploaded file name so it is safe to show in terminals and headers.
+func sanitizeFileName(name string) string {
+	name = strings.ToValidUTF8(name, "")
+	name = strings.Map(func(r rune) rune {
+		switch {
+		case r == '/' || r == '\\':
+			return '_'
+		case unicode.IsControl(r):
+			return -1
+		}
+		return r
+	}, name)
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." {
+		return "download"
+	}
+	return name
+}
+
+// contentDisposition builds a Content-Disposition header value with an ASCII
+// fallback file name and an RFC 5987 UTF-8 encoded filename* parameter.
+func contentDisposition(disposition, fileName string) string {
+	var fallback, encoded strings.Builder
+	for _, r := range fileName {
+		if r < utf8.RuneSelf && r >= 0x20 && r != '"' && r != '\\' && r != 0x7f {
+			fallback.WriteRune(r)
+		} else {
+			fallback.WriteByte('_')
+		}
+	}
+	for i := 0; i < len(fileName); i++ {
+		c := fileName[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("!#$&+-.^_`|~", c) >= 0 {
+			encoded.WriteByte(c)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", c)
+		}
+	}
+	return fmt.Sprintf("%s; filename=\"%s\"; filename*=UTF-8''%s", disposition, fallback.String(), encoded.String())
+}
+
+// shellQuote quotes s for use as a single POSIX shell word.
+func shellQuote(s string) string {
+	safe := true
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.,+:@%/", c) >= 0) {
+			safe = false
+			break
+		}
+	}
+	if safe && s != "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
 const (
 	noWritten     = -1
 	defaultStatus = http.StatusOK
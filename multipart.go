@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+)
+
+var errNoFormFile = errors.New("The form contains no file.")
+
+// formBoundary returns the boundary of a multipart/form-data upload, or an
+// empty string if the upload is a raw request body.
+func formBoundary(r *http.Request) string {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/form-data" {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// Longest form field kept by formFile; the rest of a field is skipped.
+const maxFormFieldSize = 8 << 10
+
+// formFile returns the first file part of a multipart/form-data body, along
+// with the form fields before it. The part is read as it arrives, so the rest
+// of the body is streamed rather than buffered.
+func formFile(body io.Reader, boundary string) (*multipart.Part, url.Values, error) {
+	fields := url.Values{}
+	mr := multipart.NewReader(body, boundary)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, nil, errNoFormFile
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if part.FileName() != "" {
+			return part, fields, nil
+		}
+		value, err := io.ReadAll(io.LimitReader(part, maxFormFieldSize))
+		if err != nil {
+			return nil, nil, err
+		}
+		if name := part.FormName(); name != "" {
+			fields.Add(name, string(value))
+		}
+		if _, err := io.Copy(io.Discard, part); err != nil {
+			return nil, nil, err
+		}
+	}
+}
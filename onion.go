@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Password of the Tor control port, if it uses HashedControlPassword. Cookie authentication is used otherwise.
+var torControlPassword = os.Getenv("TOR_CONTROL_PASSWORD")
+
+// onionService is an onion service published through a Tor control port.
+type onionService struct {
+	controlAddr string
+	key         string // Private key in the form ADD_ONION takes.
+	target      string
+	conn        *textproto.Conn // Control connection. Tor removes the service when it closes.
+}
+
+// Published onion services.
+var onionServices []*onionService
+
+// onionListener accepts the connections Tor forwards from an onion service.
+type onionListener struct {
+	net.Listener
+	baseURL string
+}
+
+// onionConn is a connection that came through an onion service.
+type onionConn struct {
+	net.Conn
+	baseURL string
+}
+
+func (l onionListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &onionConn{c, l.baseURL}, nil
+}
+
+// listenOnion publishes an onion service through the Tor control port at
+// controlAddr and returns the listener of its connections. The private key of
+// the service is kept in keyFile, so that its address is the same on every run.
+// A new address is used on each run if keyFile is empty.
+func listenOnion(controlAddr, keyFile, virtualPort string) (net.Listener, error) {
+	if virtualPort == "" {
+		virtualPort = "80"
+	}
+	if _, err := strconv.ParseUint(virtualPort, 10, 16); err != nil {
+		return nil, fmt.Errorf("invalid onion port %q", virtualPort)
+	}
+	key := "NEW:ED25519-V3"
+	if keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err == nil {
+			key = strings.TrimSpace(string(data))
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	// Tor forwards the connections to a loopback port only it reaches.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	conn, err := textproto.Dial("tcp", controlAddr)
+	if err != nil {
+		l.Close()
+		return nil, err
+	}
+	target := virtualPort + "," + l.Addr().String()
+	serviceID, privateKey, err := addOnion(conn, key, target)
+	if err != nil {
+		conn.Close()
+		l.Close()
+		return nil, err
+	}
+	if privateKey != "" {
+		if keyFile != "" {
+			if err := os.WriteFile(keyFile, []byte(privateKey+"\n"), 0600); err != nil {
+				conn.Close()
+				l.Close()
+				return nil, err
+			}
+		}
+		key = privateKey
+	}
+	onionServices = append(onionServices, &onionService{controlAddr, key, target, conn})
+
+	host := serviceID + ".onion"
+	if virtualPort != "80" {
+		host = net.JoinHostPort(host, virtualPort)
+	}
+	baseURL := (&url.URL{Scheme: "http", Host: host}).String()
+	log.Printf("Publishing onion service %s.\n", baseURL)
+	return onionListener{l, baseURL}, nil
+}
+
+// addOnion authenticates to the Tor control port and adds an onion service
+// with key that forwards to target. It returns the service ID and, for a new
+// key, the private key.
+func addOnion(conn *textproto.Conn, key, target string) (serviceID, privateKey string, err error) {
+	methods, cookieFile, err := protocolInfo(conn)
+	if err != nil {
+		return "", "", err
+	}
+	var secret string
+	switch {
+	case torControlPassword != "":
+		secret = strconv.Quote(torControlPassword)
+	case methods["NULL"]:
+	case methods["COOKIE"]:
+		cookie, err := os.ReadFile(cookieFile)
+		if err != nil {
+			return "", "", err
+		}
+		secret = hex.EncodeToString(cookie)
+	default:
+		return "", "", errors.New("the Tor control port needs a password; set TOR_CONTROL_PASSWORD")
+	}
+	if _, err := torCommand(conn, strings.TrimSpace("AUTHENTICATE "+secret)); err != nil {
+		return "", "", err
+	}
+
+	reply, err := torCommand(conn, "ADD_ONION "+key+" Port="+target)
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(reply, "\n") {
+		name, value, _ := strings.Cut(line, "=")
+		switch name {
+		case "ServiceID":
+			serviceID = value
+		case "PrivateKey":
+			privateKey = value
+		}
+	}
+	if serviceID == "" {
+		return "", "", errors.New("Tor returned no onion service ID")
+	}
+	return serviceID, privateKey, nil
+}
+
+// protocolInfo returns the authentication methods the Tor control port
+// accepts and its cookie file.
+func protocolInfo(conn *textproto.Conn) (methods map[string]bool, cookieFile string, err error) {
+	reply, err := torCommand(conn, "PROTOCOLINFO 1")
+	if err != nil {
+		return nil, "", err
+	}
+	methods = make(map[string]bool)
+	for _, line := range strings.Split(reply, "\n") {
+		if !strings.HasPrefix(line, "AUTH ") {
+			continue
+		}
+		auth := strings.TrimPrefix(line, "AUTH ")
+		for _, field := range strings.Fields(auth) {
+			if name, list, _ := strings.Cut(field, "="); name == "METHODS" {
+				for _, m := range strings.Split(list, ",") {
+					methods[m] = true
+				}
+			}
+		}
+		if _, quoted, ok := strings.Cut(auth, "COOKIEFILE="); ok {
+			if cookieFile, err = strconv.QuotedPrefix(quoted); err == nil {
+				cookieFile, err = strconv.Unquote(cookieFile)
+			}
+			if err != nil {
+				return nil, "", fmt.Errorf("invalid Tor cookie file: %w", err)
+			}
+		}
+	}
+	return methods, cookieFile, nil
+}
+
+// torCommand sends a command to the Tor control port and returns the lines of
+// its reply.
+func torCommand(conn *textproto.Conn, command string) (string, error) {
+	if err := conn.PrintfLine("%s", command); err != nil {
+		return "", err
+	}
+	_, reply, err := conn.ReadResponse(250)
+	if err != nil {
+		return "", fmt.Errorf("Tor control port: %w", err)
+	}
+	return reply, nil
+}
+
+// releaseOnions closes the control connections of the onion services, so
+// that a new process can publish them with the same keys.
+func releaseOnions() {
+	for _, s := range onionServices {
+		if s.conn != nil {
+			s.conn.Close()
+			s.conn = nil
+		}
+	}
+}
+
+// republishOnions publishes the released onion services again, when no new
+// process took them over.
+func republishOnions() {
+	for _, s := range onionServices {
+		if s.conn != nil {
+			continue
+		}
+		conn, err := textproto.Dial("tcp", s.controlAddr)
+		if err == nil {
+			if _, _, err = addOnion(conn, s.key, s.target); err != nil {
+				conn.Close()
+			}
+		}
+		if err != nil {
+			log.Printf("Error publishing onion service again. %s", err)
+			continue
+		}
+		s.conn = conn
+	}
+}
+
+// onionURL returns the URL of the onion service r came through, if any.
+func onionURL(r *http.Request) string {
+	if c, ok := r.Context().Value(connContextKey{}).(*onionConn); ok {
+		return c.baseURL
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// uploadOptions are the per-upload settings requested in the query string.
+type uploadOptions struct {
+	wait      time.Duration // How long to wait for a client to connect.
+	confirm   bool          // Whether the receiver must present a confirmation code and be approved.
+	parallel  bool          // Whether the file is spooled so it can be downloaded over several ranged connections.
+	segmented bool          // Whether the file is sent in checksummed segments that the receiver acknowledges.
+	emails    []string      // Addresses the download link is emailed to.
+	inline    bool          // Whether browsers should display the file instead of saving it.
+	id        string        // File ID chosen by the uploader, if any.
+	digest    string        // Algorithm of the segment digests.
+	note      string        // Message from the uploader shown to the receiver.
+	public    bool          // Whether the transfer is listed on the browse page.
+	archive   bool          // Whether a copy of the file is kept in ARCHIVE_DIR.
+}
+
+// parseUploadOptions reads the upload options from the request and applies
+// the server defaults and limits.
+func parseUploadOptions(r *http.Request) (uploadOptions, error) {
+	query := r.URL.Query()
+	options := uploadOptions{wait: waitTimeout}
+
+	if wait := query.Get("wait"); wait != "" {
+		d, err := time.ParseDuration(wait)
+		if err != nil || d <= 0 {
+			return options, fmt.Errorf("invalid wait duration %q", wait)
+		}
+		options.wait = d
+		if options.wait > maxWaitTimeout {
+			options.wait = maxWaitTimeout
+		}
+	}
+
+	if confirm := query.Get("confirm"); confirm != "" {
+		b, err := strconv.ParseBool(confirm)
+		if err != nil {
+			return options, fmt.Errorf("invalid confirm value %q", confirm)
+		}
+		options.confirm = b
+	}
+
+	if parallel := query.Get("parallel"); parallel != "" {
+		b, err := strconv.ParseBool(parallel)
+		if err != nil {
+			return options, fmt.Errorf("invalid parallel value %q", parallel)
+		}
+		options.parallel = b
+	}
+	if segmented := query.Get("segmented"); segmented != "" {
+		b, err := strconv.ParseBool(segmented)
+		if err != nil {
+			return options, fmt.Errorf("invalid segmented value %q", segmented)
+		}
+		// Segments are served from the spool.
+		options.segmented = b
+		options.parallel = options.parallel || b
+	}
+	digest := query.Get("digest")
+	if digest == "" {
+		digest = r.Header.Get("X-Streamer-Digest")
+	}
+	if digest != "" {
+		name, ok := digestAlgorithm(digest)
+		if !ok {
+			return options, fmt.Errorf("unsupported digest algorithm %q", digest)
+		}
+		if !options.segmented {
+			return options, errors.New("Digests are only used by segmented transfers.")
+		}
+		options.digest = name
+	} else {
+		options.digest = defaultDigestAlgorithm
+	}
+
+	if options.parallel {
+		if spoolDir == "" {
+			return options, errors.New("Parallel downloads are disabled.")
+		}
+		if r.ContentLength < 0 || formBoundary(r) != "" {
+			return options, errors.New("Parallel downloads require the file size in Content-Length.")
+		}
+	}
+
+	if public := query.Get("public"); public != "" {
+		b, err := strconv.ParseBool(public)
+		if err != nil {
+			return options, fmt.Errorf("invalid public value %q", public)
+		}
+		options.public = b
+	}
+
+	if archive := query.Get("archive"); archive != "" {
+		b, err := strconv.ParseBool(archive)
+		if err != nil {
+			return options, fmt.Errorf("invalid archive value %q", archive)
+		}
+		if b && archiveDir == "" {
+			return options, errors.New("Archiving is disabled.")
+		}
+		options.archive = b
+	}
+
+	if email := query.Get("email"); email != "" {
+		if smtpHost == "" {
+			return options, errors.New("Email delivery is disabled.")
+		}
+		list, err := mail.ParseAddressList(email)
+		if err != nil {
+			return options, fmt.Errorf("invalid email %q", email)
+		}
+		if len(list) > maxEmailRecipients {
+			return options, fmt.Errorf("at most %d email recipients are allowed", maxEmailRecipients)
+		}
+		for _, addr := range list {
+			options.emails = append(options.emails, addr.Address)
+		}
+	}
+
+	if id := query.Get("id"); id != "" {
+		if err := validateCustomID(id); err != nil {
+			return options, err
+		}
+		options.id = id
+	}
+
+	note := query.Get("note")
+	if note == "" {
+		note = r.Header.Get("X-Streamer-Note")
+		if decoded, err := new(mime.WordDecoder).DecodeHeader(note); err == nil {
+			note = decoded
+		}
+	}
+	if note != "" {
+		options.note = sanitizeNote(note)
+		if utf8.RuneCountInString(options.note) > maxNoteLength {
+			return options, fmt.Errorf("the note must have at most %d characters", maxNoteLength)
+		}
+	}
+
+	if disposition := query.Get("disposition"); disposition != "" {
+		inline, err := parseDisposition(disposition)
+		if err != nil {
+			return options, err
+		}
+		options.inline = inline
+	}
+
+	return options, nil
+}
+
+// Maximum length of an upload note in characters.
+const maxNoteLength = 500
+
+// sanitizeNote strips control characters other than line breaks and invalid
+// UTF-8 from an upload note, so it is safe to show in terminals.
+func sanitizeNote(note string) string {
+	note = strings.ToValidUTF8(note, "")
+	note = strings.Map(func(r rune) rune {
+		if r != '\n' && unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, note)
+	return strings.TrimSpace(note)
+}
+
+// parseDisposition reports whether a disposition query parameter asks for
+// inline display.
+func parseDisposition(disposition string) (bool, error) {
+	switch disposition {
+	case "inline":
+		return true, nil
+	case "attachment":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid disposition %q", disposition)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// preflightResult describes the transfer an upload with the same request
+// would create, with the limits that apply to it.
+type preflightResult struct {
+	Name        string   `json:"name"`
+	ContentType string   `json:"content_type"`
+	Size        *int64   `json:"size"`
+	DownloadURL string   `json:"download_url"` // Has {id} in place of the ID unless the uploader chose it.
+	Wait        int64    `json:"wait"`         // Seconds the upload waits for a client to connect.
+	MaxWait     int64    `json:"max_wait"`
+	Confirm     bool     `json:"confirm"`
+	Parallel    bool     `json:"parallel"`
+	Segmented   bool     `json:"segmented"`
+	SegmentSize int      `json:"segment_size,omitempty"`
+	Digest      string   `json:"digest,omitempty"`
+	Emails      []string `json:"emails,omitempty"`
+	Inline      bool     `json:"inline"`
+	Public      bool     `json:"public"`
+	Archive     bool     `json:"archive"`
+	ShortLink   bool     `json:"short_link"`
+	Resume      bool     `json:"resume"`    // Whether the upload can resume if its connection breaks.
+	Reconnect   bool     `json:"reconnect"` // Whether the receiver can reconnect if its connection breaks.
+}
+
+// preflight checks the credentials and upload options of r, a POST to the
+// upload URL of name with the preflight query parameter and no body, the way
+// an upload would, and describes the transfer it would create without
+// creating it. The size is taken from the size query parameter.
+func preflight(w http.ResponseWriter, r *http.Request, name string) {
+	if !authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="streamer"`)
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	if r.ContentLength != 0 {
+		http.Error(w, "A preflight request must not have a body.", http.StatusBadRequest)
+		return
+	}
+	if draining.Load() {
+		http.Error(w, errShuttingDown.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	query := r.URL.Query()
+	// Options that depend on the body are checked against the size of the
+	// file to be uploaded instead.
+	upload := r.Clone(r.Context())
+	upload.ContentLength = -1
+	if s := query.Get("size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid size %q", s), http.StatusBadRequest)
+			return
+		}
+		upload.ContentLength = n
+	}
+	options, err := parseUploadOptions(upload)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fileID := "{id}"
+	if options.id != "" {
+		fileID = options.id
+		clientsRWMutex.RLock()
+		_, exists := clients[fileID]
+		clientsRWMutex.RUnlock()
+		if exists {
+			http.Error(w, "File already exists. Choose a different name.", http.StatusBadRequest)
+			return
+		}
+	}
+
+	fileName := sanitizeFileName(name)
+	result := preflightResult{
+		Name:        fileName,
+		ContentType: uploadContentType(r.Header.Get("Content-Type"), fileName),
+		DownloadURL: fmt.Sprintf("%s/%s/%s", baseURL(r), prefix, fileID),
+		Wait:        int64(options.wait / time.Second),
+		MaxWait:     int64(maxWaitTimeout / time.Second),
+		Confirm:     options.confirm,
+		Parallel:    options.parallel,
+		Segmented:   options.segmented,
+		Emails:      options.emails,
+		Inline:      options.inline,
+		Public:      options.public,
+		Archive:     options.archive,
+		ShortLink:   shortLinkLength > 0,
+		Resume:      resumeTimeout > 0,
+		Reconnect:   downloadResumeTimeout > 0 && !options.parallel,
+	}
+	if upload.ContentLength >= 0 {
+		result.Size = &upload.ContentLength
+	}
+	if options.segmented {
+		result.SegmentSize = segmentSize
+		result.Digest = options.digest
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Whether to trust forwarding headers (X-Forwarded-*, X-Real-IP and Forwarded) set by a reverse proxy (true or false).
+// Ignored when TRUSTED_PROXIES is set.
+var trustProxyHeaders = os.Getenv("TRUST_PROXY_HEADERS") == "true"
+
+// Networks of reverse proxies whose forwarding headers are trusted, from the comma-separated TRUSTED_PROXIES
+// list of CIDRs or IP addresses (e.g., 10.0.0.0/8,192.168.1.10).
+var trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses a comma-separated list of CIDRs and IP addresses.
+func parseTrustedProxies(list string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Panicf("TRUSTED_PROXIES contains an invalid address: %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Panicf("TRUSTED_PROXIES contains an invalid network: %q", entry)
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets
+}
+
+// isTrustedProxy reports whether forwarding headers from the peer at ip are
+// trusted.
+func isTrustedProxy(ip string) bool {
+	if len(trustedProxies) == 0 {
+		return trustProxyHeaders
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		// Unix domain socket peers are local proxies.
+		return ip == ""
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the IP address of the connection peer that sent r.
+func peerIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		// Unix domain socket peers have no IP address.
+		return ""
+	}
+	return host
+}
+
+// clientIP returns the IP address of the client that sent r, as reported by
+// trusted proxies in front of the service.
+func clientIP(r *http.Request) string {
+	ip := peerIP(r)
+	// Tor is the peer of onion service clients, but passes on no headers.
+	if !isTrustedProxy(ip) || onionURL(r) != "" {
+		return ip
+	}
+
+	// Walk the X-Forwarded-For chain from the nearest proxy back to the first
+	// address not added by a trusted proxy.
+	if forwardedFor := r.Header.Values("X-Forwarded-For"); len(forwardedFor) > 0 {
+		chain := strings.Split(strings.Join(forwardedFor, ","), ",")
+		for i := len(chain) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(chain[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			ip = hop
+			if !isTrustedProxy(hop) {
+				break
+			}
+		}
+		return ip
+	}
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	if forwarded := forwardedParam(r, "for"); forwarded != "" {
+		if host, _, err := net.SplitHostPort(forwarded); err == nil {
+			forwarded = host
+		}
+		forwarded = strings.TrimSuffix(strings.TrimPrefix(forwarded, "["), "]")
+		if net.ParseIP(forwarded) != nil {
+			return forwarded
+		}
+	}
+	return ip
+}
+
+// baseURL returns the URL clients use to reach the service, either the
+// configured DOWNLOAD_BASE_URL or one derived from the request. Requests
+// through an onion service get links to the onion service.
+func baseURL(r *http.Request) string {
+	if onion := onionURL(r); onion != "" {
+		return onion
+	}
+	if downloadBaseUrl != "" {
+		return downloadBaseUrl
+	}
+
+	host := r.Host
+	if isTrustedProxy(peerIP(r)) {
+		if forwardedHost := firstHeaderValue(r, "X-Forwarded-Host"); forwardedHost != "" {
+			host = forwardedHost
+		} else if forwardedHost := forwardedParam(r, "host"); forwardedHost != "" {
+			host = forwardedHost
+		}
+	}
+	return (&url.URL{Scheme: requestScheme(r), Host: host}).String()
+}
+
+// requestScheme returns the scheme, http or https, the client used to send r.
+func requestScheme(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	if isTrustedProxy(peerIP(r)) {
+		forwardedProto := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto"))
+		if forwardedProto == "" {
+			forwardedProto = strings.ToLower(forwardedParam(r, "proto"))
+		}
+		if forwardedProto == "http" || forwardedProto == "https" {
+			scheme = forwardedProto
+		}
+	}
+	return scheme
+}
+
+// firstHeaderValue returns the first element of a comma-separated header.
+// Proxies append to these headers, so the first value is the client's.
+func firstHeaderValue(r *http.Request, name string) string {
+	value, _, _ := strings.Cut(r.Header.Get(name), ",")
+	return strings.TrimSpace(value)
+}
+
+// forwardedParam returns a parameter of the first element of the RFC 7239
+// Forwarded header.
+func forwardedParam(r *http.Request, name string) string {
+	element, _, _ := strings.Cut(r.Header.Get("Forwarded"), ",")
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, name) {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+)
+
+// proxyV2 returns a v2 header with the version and command byte verCmd, the
+// family and protocol byte fam and payload.
+func proxyV2(verCmd, fam byte, payload []byte) []byte {
+	header := append([]byte{}, proxyV2Signature...)
+	header = append(header, verCmd, fam, 0, 0)
+	binary.BigEndian.PutUint16(header[14:], uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	ipv4 := []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	ipv6 := append(append(append([]byte{}, bytes.Repeat([]byte{0x20, 0x01}, 8)...), bytes.Repeat([]byte{0xfe, 0x80}, 8)...), 0xdc, 0x04, 0x01, 0xbb)
+	tests := []struct {
+		name   string
+		input  []byte
+		remote string // Empty for local connections.
+		local  string
+		err    bool
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", "[2001:db8::2]:443", false},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), "", "", false},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN 192.0.2.1 198.51.100.1 56324 443\r\n"), "", "", false},
+		{"v1 without CR", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\n"), "", "", true},
+		{"v1 invalid address", []byte("PROXY TCP4 192.0.2 198.51.100.1 56324 443\r\n"), "", "", true},
+		{"v1 invalid port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 65536 443\r\n"), "", "", true},
+		{"v1 missing port", []byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324\r\n"), "", "", true},
+		{"v1 invalid protocol", []byte("PROXY UDP4 192.0.2.1 198.51.100.1 56324 443\r\n"), "", "", true},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1 198.51"), "", "", true},
+		{"v1 oversized", []byte("PROXY TCP4 " + strings.Repeat("1", 200) + "\r\n"), "", "", true},
+		{"v2 TCP4", proxyV2(0x21, 0x11, ipv4), "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v2 TCP6", proxyV2(0x21, 0x21, ipv6), "[2001:2001:2001:2001:2001:2001:2001:2001]:56324", "[fe80:fe80:fe80:fe80:fe80:fe80:fe80:fe80]:443", false},
+		{"v2 with TLVs", proxyV2(0x21, 0x11, append(append([]byte{}, ipv4...), 0x04, 0x00, 0x01, 0x00)), "192.0.2.1:56324", "198.51.100.1:443", false},
+		{"v2 LOCAL", proxyV2(0x20, 0x00, nil), "", "", false},
+		{"v2 LOCAL with addresses", proxyV2(0x20, 0x11, ipv4), "", "", false},
+		{"v2 unspecified family", proxyV2(0x21, 0x00, nil), "", "", false},
+		{"v2 Unix", proxyV2(0x21, 0x31, make([]byte, 216)), "", "", false},
+		{"v2 unknown command", proxyV2(0x22, 0x11, ipv4), "", "", true},
+		{"v2 version 1", proxyV2(0x11, 0x11, ipv4), "", "", true},
+		{"v2 short addresses", proxyV2(0x21, 0x11, ipv4[:8]), "", "", true},
+		{"v2 short IPv6 addresses", proxyV2(0x21, 0x21, ipv4), "", "", true},
+		{"v2 truncated header", proxyV2(0x21, 0x11, ipv4)[:14], "", "", true},
+		{"v2 truncated payload", proxyV2(0x21, 0x11, ipv4)[:20], "", "", true},
+		{"no header", []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"), "", "", true},
+		{"short input", []byte("PROXY"), "", "", true},
+		{"empty", nil, "", "", true},
+	}
+	for _, test := range tests {
+		remote, local, err := readProxyHeader(bufio.NewReader(bytes.NewReader(test.input)))
+		if test.err {
+			if err == nil {
+				t.Errorf("%s: got %v, %v, want an error", test.name, remote, local)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if test.remote == "" {
+			if remote != nil || local != nil {
+				t.Errorf("%s: got %v, %v, want no addresses", test.name, remote, local)
+			}
+			continue
+		}
+		if remote == nil || local == nil || remote.String() != test.remote || local.String() != test.local {
+			t.Errorf("%s: got %v, %v, want %s, %s", test.name, remote, local, test.remote, test.local)
+		}
+	}
+}
+
+// TestReadProxyHeaderLeavesRequest checks that only the header is consumed.
+func TestReadProxyHeaderLeavesRequest(t *testing.T) {
+	request := "GET / HTTP/1.1\r\n\r\n"
+	for _, header := range [][]byte{
+		[]byte("PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n"),
+		proxyV2(0x21, 0x11, []byte{192, 0, 2, 1, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}),
+		proxyV2(0x20, 0x00, nil),
+	} {
+		r := bufio.NewReader(bytes.NewReader(append(header, request...)))
+		if _, _, err := readProxyHeader(r); err != nil {
+			t.Fatal(err)
+		}
+		rest, _ := io.ReadAll(r)
+		if string(rest) != request {
+			t.Errorf("got %q after the header, want %q", rest, request)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// relay streams body to the receiver of c, or to the spool the receiver
+// downloads from. If the receiver fails before any data reached it, the
+// transfer is handed over to the next queued client.
+func (c *client) relay(body io.Reader, buf []byte) error {
+	var rc *receiver
+	var w io.Writer = c.spool
+	if c.spool != nil {
+		close(c.spool.ready)
+	} else {
+		clientsRWMutex.RLock()
+		rc = c.receiver
+		clientsRWMutex.RUnlock()
+		c.setRelayHeaders(rc)
+		w = rc.w
+	}
+	defer func() {
+		if rc != nil && rc.conn != nil && downloadStallTimeout > 0 {
+			// The connection may serve further requests.
+			rc.conn.SetWriteDeadline(time.Time{})
+		}
+	}()
+
+	for {
+		if uploadStallTimeout > 0 {
+			clientsRWMutex.RLock()
+			conn := c.conn
+			clientsRWMutex.RUnlock()
+			conn.SetReadDeadline(time.Now().Add(uploadStallTimeout))
+			// An abort may have set an earlier deadline.
+			if abortErr := c.abortError(); abortErr != nil {
+				return abortErr
+			}
+		}
+		n, err := body.Read(buf)
+		if n > 0 && c.archive != nil {
+			if _, aerr := c.archive.Write(buf[:n]); aerr != nil {
+				log.Printf("Error archiving %s. %s", c.fileName, aerr)
+				return errArchiveFailed
+			}
+		}
+		for n > 0 {
+			if rc != nil && rc.conn != nil && downloadStallTimeout > 0 {
+				rc.conn.SetWriteDeadline(time.Now().Add(downloadStallTimeout))
+			}
+			written, werr := w.Write(buf[:n])
+			if werr == nil {
+				c.transferred.Add(int64(written))
+				if c.rewind != nil {
+					c.rewind.Write(buf[:written])
+				}
+				break
+			}
+			if rc == nil {
+				return werr
+			}
+			if c.rewind != nil && c.transferred.Load()+int64(written) > 0 {
+				// The receiver may reconnect and continue from the bytes it
+				// got, so keep the ones that were written.
+				c.transferred.Add(int64(written))
+				c.rewind.Write(buf[:written])
+				n = copy(buf, buf[written:n])
+				var rerr error
+				if rc, rerr = c.reconnect(rc, werr); rerr != nil {
+					return rerr
+				}
+				w = rc.w
+				continue
+			}
+			if isTimeout(werr) {
+				return stalled("receiver", downloadStallTimeout)
+			}
+			if c.transferred.Load() > 0 || c.approved != nil {
+				// Data was lost or the next client was not approved.
+				return receiverDisconnected(c.transferred.Load())
+			}
+			if rc = c.handOver(rc, werr); rc == nil {
+				return werr
+			}
+			c.emit(connectedEvent(rc))
+			go c.reportHostname(rc)
+			c.setRelayHeaders(rc)
+			w = rc.w
+		}
+		if err == io.EOF {
+			if c.size < 0 || c.transferred.Load() >= c.size {
+				return nil
+			}
+			// The upload connection closed early.
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			if abortErr := c.abortError(); abortErr != nil {
+				return abortErr
+			}
+			if uploadStallTimeout > 0 && isTimeout(err) {
+				err = stalled("uploader", uploadStallTimeout)
+			}
+			if c.resumes == nil {
+				return err
+			}
+			if body, err = c.suspend(err); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// setRelayHeaders sets the headers of the response that relays c to rc.
+func (c *client) setRelayHeaders(rc *receiver) {
+	setTransferHeaders(rc.w.Header(), c, rc.inline)
+	// HTTP/1.1 only sends trailers after a chunked body, which a known size
+	// rules out. The connection is only shared over HTTP/2.
+	if c.size < 0 || rc.conn == nil {
+		rc.w.Header().Set("Trailer", statsTrailers)
+	}
+	if c.rewind != nil {
+		rc.w.Header().Set("X-Streamer-Resume-Token", c.resumeToken)
+	}
+}
+
+// handOver ends the transfer to a failed receiver and starts it for the next
+// queued client, which it returns. It returns nil if no client is queued.
+func (c *client) handOver(failed *receiver, err error) *receiver {
+	clientsRWMutex.Lock()
+	c.receiver = nil
+	c.promote()
+	next := c.receiver
+	if next != nil {
+		next.start()
+	}
+	clientsRWMutex.Unlock()
+
+	failed.done <- err
+	return next
+}
+
+// notifyConnected tells the uploader that a receiver is ready.
+func (c *client) notifyConnected() {
+	select {
+	case c.clientConnected <- true:
+	default:
+	}
+}
+
+// promote makes the first queued client the receiver if there is none.
+// clientsRWMutex must be held.
+func (c *client) promote() {
+	if c.receiver != nil || len(c.queue) == 0 {
+		return
+	}
+	c.receiver = c.queue[0]
+	c.queue = c.queue[1:]
+	for _, queued := range c.queue {
+		queued.notifyMoved()
+	}
+	c.notifyConnected()
+}
+
+// leave removes a client that disconnected before the transfer started
+// streaming to it. It returns false if the transfer already started.
+func (c *client) leave(rc *receiver) bool {
+	clientsRWMutex.Lock()
+	defer clientsRWMutex.Unlock()
+	if rc.started {
+		return false
+	}
+	if c.receiver == rc {
+		c.receiver = nil
+		c.promote()
+		if c.approved != nil {
+			// Wake up the uploader waiting to approve this client.
+			select {
+			case c.approved <- false:
+			default:
+			}
+		}
+		return true
+	}
+	for i, queued := range c.queue {
+		if queued == rc {
+			c.queue = append(c.queue[:i], c.queue[i+1:]...)
+			for _, queued := range c.queue[i:] {
+				queued.notifyMoved()
+			}
+			break
+		}
+	}
+	return true
+}
+
+// position returns the 1-based queue position of rc, or 0 if it is not
+// queued. clientsRWMutex must be held.
+func (c *client) position(rc *receiver) int {
+	for i, queued := range c.queue {
+		if queued == rc {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// notifyMoved signals rc that its queue position changed.
+func (rc *receiver) notifyMoved() {
+	select {
+	case rc.moved <- struct{}{}:
+	default:
+	}
+}
+
+// start marks rc as owned by the transfer. clientsRWMutex must be held.
+func (rc *receiver) start() {
+	rc.mu.Lock()
+	rc.started = true
+	rc.mu.Unlock()
+}
+
+// sendPosition tells a queued client its position with an informational
+// response, which doesn't end the request.
+func (rc *receiver) sendPosition(position int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if rc.started || position == 0 {
+		return
+	}
+	rc.w.Header().Set("X-Streamer-Queue-Position", strconv.Itoa(position))
+	rc.w.WriteHeader(http.StatusProcessing)
+	rc.w.Header().Del("X-Streamer-Queue-Position")
+}
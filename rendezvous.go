@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Longest a download can wait for an upload to its link to start (e.g., 10m).
+// Downloads of unknown links fail at once when zero.
+var rendezvousTimeout time.Duration
+
+// Length limits of file IDs chosen by the uploader. The ID is the secret of the link.
+const minCustomIDLength = 16
+const maxCustomIDLength = 64
+
+// arrival wakes the downloads waiting for an upload to a file ID.
+type arrival struct {
+	ch      chan struct{}
+	waiters int
+}
+
+// Pending arrivals keyed by file ID, guarded by clientsRWMutex.
+var arrivals = make(map[string]*arrival)
+
+// validateCustomID checks a file ID chosen by the uploader.
+func validateCustomID(id string) error {
+	if len(id) < minCustomIDLength || len(id) > maxCustomIDLength {
+		return fmt.Errorf("The id must have %d to %d characters.", minCustomIDLength, maxCustomIDLength)
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '-' || c == '_') {
+			return errors.New("The id may only contain letters, digits, - and _.")
+		}
+	}
+	return nil
+}
+
+// arrived wakes the downloads waiting for fileID. clientsRWMutex must be held.
+func arrived(fileID string) {
+	if a, ok := arrivals[fileID]; ok {
+		close(a.ch)
+		delete(arrivals, fileID)
+	}
+}
+
+// awaitUpload waits up to the ?wait duration of r, capped at
+// RENDEZVOUS_TIMEOUT, for an upload to fileID to start, and returns it.
+func awaitUpload(r *http.Request, fileID string) (*client, bool) {
+	wait := r.URL.Query().Get("wait")
+	if rendezvousTimeout <= 0 || wait == "" || r.Method != "GET" {
+		return nil, false
+	}
+	timeout, err := time.ParseDuration(wait)
+	if err != nil || timeout <= 0 || validateCustomID(fileID) != nil {
+		return nil, false
+	}
+	if timeout > rendezvousTimeout {
+		timeout = rendezvousTimeout
+	}
+
+	clientsRWMutex.Lock()
+	if c, ok := clients[fileID]; ok {
+		clientsRWMutex.Unlock()
+		return c, true
+	}
+	if draining.Load() {
+		clientsRWMutex.Unlock()
+		return nil, false
+	}
+	a, ok := arrivals[fileID]
+	if !ok {
+		a = &arrival{ch: make(chan struct{})}
+		arrivals[fileID] = a
+	}
+	a.waiters++
+	clientsRWMutex.Unlock()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-a.ch:
+	case <-timer.C:
+	case <-r.Context().Done():
+	}
+
+	clientsRWMutex.Lock()
+	defer clientsRWMutex.Unlock()
+	a.waiters--
+	if a.waiters == 0 && arrivals[fileID] == a {
+		delete(arrivals, fileID)
+	}
+	c, ok := clients[fileID]
+	return c, ok
+}
+
+// wakeArrivals releases all waiting downloads, which then find no upload.
+// clientsRWMutex must be held.
+func wakeArrivals() {
+	for fileID := range arrivals {
+		arrived(fileID)
+	}
+}
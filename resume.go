@@ -0,0 +1,198 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a transfer waits for the uploader to resume after the upload connection breaks (e.g., 30s).
+// Resuming is disabled when zero.
+var resumeTimeout time.Duration
+
+var errResumeOffset = errors.New("The upload cannot resume past the bytes already received.")
+var errResumeSuperseded = errors.New("The upload was resumed from another connection.")
+
+// resumption is an uploader connection continuing a transfer whose upload
+// connection broke.
+type resumption struct {
+	offset int64     // Position in the file of the first byte of body.
+	body   io.Reader // Rest of the file.
+	conn   net.Conn
+	status *uploadStatus
+	result chan error // Outcome of the transfer, or why the resumption was rejected.
+}
+
+// suspend waits up to resumeTimeout for the uploader to resume a transfer
+// whose upload broke with cause. It returns the body to continue relaying,
+// starting right after the bytes already transferred.
+func (c *client) suspend(cause error) (io.Reader, error) {
+	transferred := c.transferred.Load()
+	c.emit(statusEvent{
+		Event:   "suspended",
+		Message: fmt.Sprintf("The upload broke after %s. Waiting %s for it to resume...", formatBytes(transferred), resumeTimeout),
+		Bytes:   transferred,
+	})
+
+	timer := time.NewTimer(resumeTimeout)
+	defer timer.Stop()
+	for {
+		var res *resumption
+		select {
+		case res = <-c.resumes:
+		case <-timer.C:
+			return nil, cause
+		case <-c.aborted:
+			return nil, c.abortError()
+		}
+
+		if res.offset > transferred {
+			res.status.w.Header().Set("X-Streamer-Offset", strconv.FormatInt(transferred, 10))
+			res.status.writeHeader(http.StatusRequestedRangeNotSatisfiable)
+			res.status.send(statusEvent{Event: "error", Message: fmt.Sprintf("Resume from byte %d or earlier.", transferred)})
+			res.result <- errResumeOffset
+			continue
+		}
+		res.status.writeHeader(http.StatusOK)
+		// Skip the bytes the receiver already has.
+		if _, err := io.CopyN(io.Discard, res.body, transferred-res.offset); err != nil {
+			res.status.send(statusEvent{Event: "error", Message: err.Error()})
+			res.result <- err
+			continue
+		}
+
+		clientsRWMutex.Lock()
+		c.conn = res.conn
+		if c.abortError() != nil {
+			res.conn.SetReadDeadline(time.Now())
+		}
+		clientsRWMutex.Unlock()
+		c.status.replace(res.status)
+		if c.resumption != nil {
+			c.resumption.result <- errResumeSuperseded
+		}
+		c.resumption = res
+		c.emit(statusEvent{Event: "resumed", Message: fmt.Sprintf("Resumed after %s.", formatBytes(transferred)), Bytes: transferred})
+		return res.body, nil
+	}
+}
+
+// resume continues a transfer from a new uploader connection after the
+// original one broke. The body holds the file from the offset given in
+// Content-Range or the offset query parameter.
+func resume(w http.ResponseWriter, r *http.Request, fileID string) {
+	if !authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="streamer"`)
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	if resumeTimeout == 0 {
+		http.Error(w, "Resuming uploads is disabled.", http.StatusBadRequest)
+		return
+	}
+
+	offset, err := resumeOffset(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length is required.", http.StatusLengthRequired)
+		return
+	}
+
+	clientsRWMutex.RLock()
+	c, ok := clients[fileID]
+	started := ok && c.receiver != nil && c.receiver.started
+	clientsRWMutex.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	if !started {
+		http.Error(w, "The transfer has not started.", http.StatusConflict)
+		return
+	}
+	if transferred := c.transferred.Load(); offset > transferred {
+		w.Header().Set("X-Streamer-Offset", strconv.FormatInt(transferred, 10))
+		http.Error(w, fmt.Sprintf("Resume from byte %d or earlier.", transferred), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+
+	audit(r, "upload_resumed", fileID, c.fileName, fmt.Sprintf("offset %d", offset))
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "webserver doesn't support hijacking", http.StatusInternalServerError)
+		return
+	}
+	conn, bufrw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+	setKeepAlive(conn)
+	res := &resumption{
+		offset: offset,
+		body:   io.LimitReader(bufrw, r.ContentLength),
+		conn:   conn,
+		status: &uploadStatus{
+			w:    &responseLogWriter{body: bufrw.Writer, header: w.Header()},
+			json: acceptsJSON(r),
+		},
+		result: make(chan error, 1),
+	}
+	if r.ProtoAtLeast(1, 1) && strings.EqualFold(r.Header.Get("Expect"), "100-continue") {
+		res.status.writeContinue()
+	}
+
+	// Interrupt the read of the old connection in case the server has not
+	// noticed it broke yet.
+	clientsRWMutex.Lock()
+	c.conn.SetReadDeadline(time.Now())
+	clientsRWMutex.Unlock()
+
+	select {
+	case c.resumes <- res:
+	case <-c.aborted:
+		res.status.writeHeader(http.StatusServiceUnavailable)
+		res.status.send(statusEvent{Event: "error", Message: c.abortError().Error()})
+		return
+	case <-time.After(resumeTimeout):
+		res.status.writeHeader(http.StatusConflict)
+		res.status.send(statusEvent{Event: "error", Message: "The transfer cannot be resumed."})
+		return
+	}
+	<-res.result
+}
+
+// resumeOffset returns the position in the file where a resumed upload
+// starts, from a Content-Range header (e.g., bytes 1024-4095/4096) or the
+// offset query parameter.
+func resumeOffset(r *http.Request) (int64, error) {
+	value := r.URL.Query().Get("offset")
+	if contentRange := r.Header.Get("Content-Range"); contentRange != "" {
+		ok := strings.HasPrefix(contentRange, "bytes ")
+		if ok {
+			value, _, ok = strings.Cut(strings.TrimPrefix(contentRange, "bytes "), "-")
+		}
+		if !ok {
+			return 0, fmt.Errorf("invalid Content-Range %q", contentRange)
+		}
+	}
+	if value == "" {
+		return 0, errors.New("Content-Range or offset is required.")
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset %q", value)
+	}
+	return offset, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long a transfer waits for the receiver to reconnect after the download connection breaks (e.g., 30s).
+// Reconnecting is disabled when zero.
+var downloadResumeTimeout time.Duration
+
+// Bytes of the most recently relayed data kept per transfer for receivers that reconnect (e.g., 8388608).
+var rewindBufferSize int
+
+var errInvalidResumeToken = errors.New("Invalid resume token.")
+
+// rewindBuffer keeps the last bytes relayed to the receiver, so that a
+// receiver whose connection broke can continue from the bytes it got even if
+// the rest were lost in transit. It is only used by the relay.
+type rewindBuffer struct {
+	buf []byte
+	end int64 // Position in the file after the last byte kept.
+}
+
+// Write keeps the end of p, dropping the oldest bytes.
+func (b *rewindBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if len(p) > len(b.buf) {
+		b.end += int64(len(p) - len(b.buf))
+		p = p[len(p)-len(b.buf):]
+	}
+	i := int(b.end % int64(len(b.buf)))
+	copied := copy(b.buf[i:], p)
+	copy(b.buf, p[copied:])
+	b.end += int64(len(p))
+	return n, nil
+}
+
+// start returns the position in the file of the oldest byte kept.
+func (b *rewindBuffer) start() int64 {
+	if b.end < int64(len(b.buf)) {
+		return 0
+	}
+	return b.end - int64(len(b.buf))
+}
+
+// since returns the bytes kept from offset on, or false if they are no longer
+// kept.
+func (b *rewindBuffer) since(offset int64) ([]byte, bool) {
+	if offset < b.start() || offset > b.end {
+		return nil, false
+	}
+	p := make([]byte, b.end-offset)
+	copied := copy(p, b.buf[int(offset%int64(len(b.buf))):])
+	copy(p[copied:], b.buf)
+	return p, true
+}
+
+// newReceiverToken returns a secret a receiver presents to reconnect or to
+// join a spooled transfer with further connections.
+func newReceiverToken() string {
+	b := make([]byte, 18)
+	if _, err := cryptorand.Read(b); err != nil {
+		log.Panicf("Error generating receiver token. %s", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// reconnect waits up to downloadResumeTimeout for the receiver to reconnect
+// after writing to failed broke with cause. The reconnected receiver is sent
+// the bytes it missed from the rewind buffer, and returned so that the relay
+// continues with it.
+func (c *client) reconnect(failed *receiver, cause error) (*receiver, error) {
+	transferred := c.transferred.Load()
+	failed.done <- cause
+	c.emit(statusEvent{
+		Event:   "download_suspended",
+		Message: fmt.Sprintf("The download broke after %s. Waiting %s for the client to reconnect...", formatBytes(transferred), downloadResumeTimeout),
+		Bytes:   transferred,
+	})
+
+	timer := time.NewTimer(downloadResumeTimeout)
+	defer timer.Stop()
+	for {
+		var rc *receiver
+		select {
+		case rc = <-c.reconnects:
+		case <-timer.C:
+			if isTimeout(cause) && downloadStallTimeout > 0 {
+				return nil, stalled("receiver", downloadStallTimeout)
+			}
+			return nil, receiverDisconnected(transferred)
+		case <-c.aborted:
+			return nil, c.abortError()
+		}
+
+		missed, ok := c.rewind.since(rc.offset)
+		if !ok {
+			rc.done <- &statusError{http.StatusRequestedRangeNotSatisfiable, fmt.Sprintf("Reconnect from byte %d to %d.", c.rewind.start(), transferred)}
+			continue
+		}
+		clientsRWMutex.Lock()
+		c.receiver = rc
+		rc.start()
+		clientsRWMutex.Unlock()
+		c.setRelayHeaders(rc)
+		if c.size >= 0 && rc.offset < c.size {
+			rc.w.Header().Set("Content-Length", strconv.FormatInt(c.size-rc.offset, 10))
+			rc.w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", rc.offset, c.size-1, c.size))
+		}
+		rc.w.WriteHeader(http.StatusPartialContent)
+		if _, err := rc.w.Write(missed); err != nil {
+			rc.done <- err
+			continue
+		}
+		c.emit(statusEvent{Event: "download_resumed", Message: fmt.Sprintf("The client from %s reconnected at %s.", rc.ip, formatBytes(rc.offset)), IP: rc.ip, Bytes: rc.offset})
+		return rc, nil
+	}
+}
+
+// reconnectDownload continues a download whose connection broke on a new
+// connection of the receiver, which presents the resume token it was given
+// and the number of bytes it has in a Range header (e.g., bytes=1048576-) or
+// the offset query parameter.
+func reconnectDownload(w http.ResponseWriter, r *http.Request, fileID string, c *client, token string) {
+	if c.reconnects == nil || subtle.ConstantTimeCompare([]byte(token), []byte(c.resumeToken)) != 1 {
+		audit(r, "resume_rejected", fileID, c.fileName, "")
+		http.Error(w, errInvalidResumeToken.Error()+"\n", http.StatusForbidden)
+		return
+	}
+	offset, err := reconnectOffset(r)
+	if err != nil {
+		http.Error(w, err.Error()+"\n", http.StatusBadRequest)
+		return
+	}
+	rc := &receiver{
+		w:      w,
+		conn:   requestConn(r),
+		ip:     clientIP(r),
+		agent:  r.UserAgent(),
+		inline: c.inlineFor(r),
+		offset: offset,
+		moved:  make(chan struct{}, 1),
+		done:   make(chan error, 1),
+	}
+	audit(r, "download_resumed", fileID, c.fileName, fmt.Sprintf("offset %d", offset))
+
+	// Interrupt the write to the old connection in case the server has not
+	// noticed it broke yet.
+	clientsRWMutex.RLock()
+	if old := c.receiver; old != nil && old.conn != nil {
+		old.conn.SetWriteDeadline(time.Now())
+	}
+	clientsRWMutex.RUnlock()
+
+	select {
+	case c.reconnects <- rc:
+	case <-c.aborted:
+		http.Error(w, c.abortError().Error()+"\n", http.StatusServiceUnavailable)
+		return
+	case <-r.Context().Done():
+		return
+	case <-time.After(downloadResumeTimeout):
+		http.Error(w, "The download cannot be resumed.\n", http.StatusConflict)
+		return
+	}
+	finishDownload(w, r, c, rc, <-rc.done)
+}
+
+// reconnectOffset returns the position in the file a reconnecting receiver
+// continues from, from an open-ended Range header (e.g., bytes=1024-) or the
+// offset query parameter.
+func reconnectOffset(r *http.Request) (int64, error) {
+	value := r.URL.Query().Get("offset")
+	if header := r.Header.Get("Range"); header != "" {
+		first, last, ok := strings.Cut(strings.TrimPrefix(header, "bytes="), "-")
+		if !ok || last != "" || !strings.HasPrefix(header, "bytes=") {
+			return 0, fmt.Errorf("invalid range %q", header)
+		}
+		value = first
+	}
+	if value == "" {
+		return 0, nil
+	}
+	offset, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || offset < 0 {
+		return 0, fmt.Errorf("invalid offset %q", value)
+	}
+	return offset, nil
+}
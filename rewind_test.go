@@ -0,0 +1,60 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestRewindBuffer writes pattern bytes in chunks of various sizes to buffers
+// of various sizes, so that writes wrap around the end of the buffer, and
+// checks the bytes kept from every offset.
+func TestRewindBuffer(t *testing.T) {
+	const total = 1000
+	input := pattern(total)
+	for _, size := range []int{1, 7, 64, 100} {
+		for _, chunk := range []int{1, 3, 7, 63, 64, 65, 99, 100, 101, 250} {
+			b := &rewindBuffer{buf: make([]byte, size)}
+			for written := 0; written < total; {
+				n := chunk
+				if n > total-written {
+					n = total - written
+				}
+				if got, err := b.Write(input[written : written+n]); got != n || err != nil {
+					t.Fatalf("Write of %d bytes = %d, %v", n, got, err)
+				}
+				written += n
+
+				start := written - size
+				if start < 0 {
+					start = 0
+				}
+				if got := b.start(); got != int64(start) {
+					t.Fatalf("buffer of %d, chunks of %d, after %d bytes: start() = %d, want %d", size, chunk, written, got, start)
+				}
+				for offset := 0; offset <= written; offset++ {
+					p, ok := b.since(int64(offset))
+					if offset < start {
+						if ok {
+							t.Fatalf("buffer of %d, chunks of %d, after %d bytes: since(%d) kept %d bytes, want none", size, chunk, written, offset, len(p))
+						}
+						continue
+					}
+					if !ok || !bytes.Equal(p, input[offset:written]) {
+						t.Fatalf("buffer of %d, chunks of %d, after %d bytes: since(%d) = %v, %v, want %v", size, chunk, written, offset, p, ok, input[offset:written])
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestRewindBufferBeyondEnd(t *testing.T) {
+	b := &rewindBuffer{buf: make([]byte, 10)}
+	b.Write(pattern(25))
+	if p, ok := b.since(26); ok {
+		t.Errorf("since(26) = %v, want nothing past the end", p)
+	}
+	if p, ok := b.since(25); !ok || len(p) != 0 {
+		t.Errorf("since(25) = %v, %v, want no bytes", p, ok)
+	}
+}
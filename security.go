@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// How long browsers should only use HTTPS for the service (e.g., 8760h). HSTS is disabled when zero.
+var hstsMaxAge time.Duration
+
+// Whether HSTS also applies to subdomains (true or false).
+var hstsIncludeSubdomains = os.Getenv("HSTS_INCLUDE_SUBDOMAINS") == "true"
+
+// Value of the X-Content-Type-Options header, or off to omit it.
+var contentTypeOptions = os.Getenv("CONTENT_TYPE_OPTIONS")
+
+// Value of the Referrer-Policy header, or off to omit it.
+var referrerPolicy = os.Getenv("REFERRER_POLICY")
+
+// Address of a plain HTTP listener that redirects to HTTPS (e.g., :80).
+var httpRedirectAddr = os.Getenv("HTTP_REDIRECT_ADDR")
+
+// secure adds security headers to responses.
+func secure(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		if contentTypeOptions != "off" {
+			h.Set("X-Content-Type-Options", contentTypeOptions)
+		}
+		if referrerPolicy != "off" {
+			h.Set("Referrer-Policy", referrerPolicy)
+		}
+		// Browsers ignore HSTS over plain HTTP.
+		if hstsMaxAge > 0 && requestScheme(r) == "https" {
+			value := fmt.Sprintf("max-age=%d", int64(hstsMaxAge/time.Second))
+			if hstsIncludeSubdomains {
+				value += "; includeSubDomains"
+			}
+			h.Set("Strict-Transport-Security", value)
+		}
+		next(w, r)
+	}
+}
+
+// redirectToHTTPS permanently redirects requests to the same URL over HTTPS.
+func redirectToHTTPS(w http.ResponseWriter, r *http.Request) {
+	target := "https://" + r.Host
+	if strings.HasPrefix(downloadBaseUrl, "https://") {
+		target = downloadBaseUrl
+	} else if host, _, err := net.SplitHostPort(r.Host); err == nil {
+		target = "https://" + host
+	}
+	w.Header().Set("Connection", "close")
+	// 308 keeps the method and body of POST requests.
+	http.Redirect(w, r, target+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// serveRedirect starts the plain HTTP listener that redirects to HTTPS, if
+// configured.
+func serveRedirect(readHeaderTimeout time.Duration) *http.Server {
+	if httpRedirectAddr == "" {
+		return nil
+	}
+	l, err := takeListener("tcp", httpRedirectAddr, func() (net.Listener, error) { return net.Listen("tcp", httpRedirectAddr) })
+	if err != nil {
+		log.Fatalf("Error listening on %s. %s", httpRedirectAddr, err)
+	}
+	// The load balancer sends the PROXY header on this port too.
+	l = withProxyProtocol(l)
+	server := &http.Server{
+		Handler:           http.HandlerFunc(redirectToHTTPS),
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      readHeaderTimeout,
+	}
+	go func() {
+		log.Printf("Redirecting to HTTPS on %s.\n", l.Addr())
+		if err := server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Fatalf("Error listening on server. %s", err)
+		}
+	}()
+	return server
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// Size in bytes of the segments of a segmented transfer.
+var segmentSize int
+
+// segmentManifest is the JSON description of a segmented transfer.
+type segmentManifest struct {
+	Name            string `json:"name"`
+	Size            int64  `json:"size"`
+	SegmentSize     int64  `json:"segment_size"`
+	Segments        int    `json:"segments"`
+	DigestAlgorithm string `json:"digest_algorithm"`
+}
+
+// segments returns the number of segments of the spool.
+func (s *spool) segments() int {
+	return int((s.size + s.segmentSize - 1) / s.segmentSize)
+}
+
+// digestSegments hashes p, which was just spooled after pos bytes, closing
+// the digest of each segment it completes.
+func (s *spool) digestSegments(p []byte, pos int64) {
+	for len(p) > 0 {
+		n := s.segmentSize - pos%s.segmentSize
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		s.hash.Write(p[:n])
+		p, pos = p[n:], pos+n
+		if pos%s.segmentSize == 0 || pos == s.size {
+			sum := s.hash.Sum(nil)
+			s.hash.Reset()
+			s.mu.Lock()
+			s.digests = append(s.digests, sum)
+			s.mu.Unlock()
+		}
+	}
+}
+
+// serveManifest describes the segments of the transfer to the client.
+func (s *spool) serveManifest(w http.ResponseWriter, c *client) {
+	if s.segments() == 0 {
+		s.signalComplete()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(segmentManifest{
+		Name:            c.fileName,
+		Size:            s.size,
+		SegmentSize:     s.segmentSize,
+		Segments:        s.segments(),
+		DigestAlgorithm: s.digest,
+	})
+}
+
+// serveSegment sends segment n once it was spooled, with its digest in the
+// Content-Digest header. A segment can be requested again until the client
+// acknowledges it. HEAD requests get the headers alone, without counting the
+// segment as served.
+func (s *spool) serveSegment(w http.ResponseWriter, r *http.Request, n int) {
+	if n < 0 || n >= s.segments() {
+		http.Error(w, "Segment not found.", http.StatusNotFound)
+		return
+	}
+	s.mu.Lock()
+	for len(s.digests) <= n && s.err == nil {
+		s.cond.Wait()
+	}
+	acked, err := s.acked[n], s.err
+	var digest []byte
+	if len(s.digests) > n {
+		digest = s.digests[n]
+	}
+	s.mu.Unlock()
+	if digest == nil {
+		http.Error(w, err.Error(), http.StatusGone)
+		return
+	}
+	if acked {
+		http.Error(w, "The segment was already acknowledged.", http.StatusGone)
+		return
+	}
+
+	start := int64(n) * s.segmentSize
+	length := s.segmentSize
+	if start+length > s.size {
+		length = s.size - start
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(length, 10))
+	h.Set("Content-Digest", s.digest+"=:"+base64.StdEncoding.EncodeToString(digest)+":")
+	h.Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == "HEAD" {
+		return
+	}
+	if written, _ := io.Copy(w, io.NewSectionReader(s.file, start, length)); written > 0 {
+		s.markServed(start, start+written)
+	}
+}
+
+// ack records that the client received segment n intact. The transfer
+// completes once every segment is acknowledged.
+func (s *spool) ack(w http.ResponseWriter, n int) {
+	s.mu.Lock()
+	if n < 0 || n >= len(s.digests) {
+		s.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Segment %d was not sent.", n), http.StatusConflict)
+		return
+	}
+	if !s.acked[n] {
+		s.acked[n] = true
+		s.ackedCount++
+	}
+	complete := s.ackedCount == s.segments()
+	s.mu.Unlock()
+	if complete {
+		s.signalComplete()
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// segment serves the segment requests of the client downloading a segmented
+// transfer: GET {n} and POST {n}/ack.
+func segment(w http.ResponseWriter, r *http.Request, fileID string, path string) {
+	clientsRWMutex.RLock()
+	client, ok := clients[fileID]
+	joined := ok && client.spool != nil && client.spool.segmentSize > 0 && client.joinedBy(r)
+	clientsRWMutex.RUnlock()
+	if !joined {
+		notFound(w, r)
+		return
+	}
+
+	index, action := path, ""
+	if i := len(path) - len("/ack"); i > 0 && path[i:] == "/ack" {
+		index, action = path[:i], "ack"
+	}
+	n, err := strconv.Atoi(index)
+	if err != nil {
+		notFound(w, r)
+		return
+	}
+	switch {
+	case action == "" && (r.Method == "GET" || r.Method == "HEAD"):
+		client.spool.serveSegment(w, r, n)
+	case action == "ack" && r.Method == "POST":
+		client.spool.ack(w, n)
+	default:
+		notFound(w, r)
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"time"
+)
+
+// selfTest uploads size bytes of random data through the handlers of server
+// on a loopback listener and downloads them again, reporting the latency and
+// throughput. The listener uses the TLS certificate of the PORT listener, if
+// any, so its cost is measured too.
+func selfTest(server *http.Server, size int64) error {
+	// The test client sends no PROXY header.
+	proxyProtocol = false
+	l, err := listenTCP("127.0.0.1:0", tlsCertFile, tlsKeyFile, "")
+	if err != nil {
+		return err
+	}
+	go server.Serve(l)
+	defer server.Close()
+
+	scheme := "http"
+	if tlsCertFile != "" {
+		scheme = "https"
+	}
+	base := fmt.Sprintf("%s://%s/%s", scheme, l.Addr(), prefix)
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:    &tls.Config{InsecureSkipVerify: true},
+		DisableCompression: true,
+	}}
+
+	uploadHash := sha256.New()
+	body := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(time.Now().UnixNano())), size), uploadHash)
+	req, err := http.NewRequest("POST", base+"/selftest.bin", body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.SetBasicAuth(validUserName, validPassword)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("upload failed: %s %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	events := bufio.NewScanner(resp.Body)
+	waiting, err := nextSelfTestEvent(events)
+	if err != nil {
+		return err
+	}
+	registered := time.Since(start)
+
+	downloadStart := time.Now()
+	download, err := client.Get(base + "/" + waiting.ID)
+	if err != nil {
+		return err
+	}
+	defer download.Body.Close()
+	if download.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", download.Status)
+	}
+	downloadHash := sha256.New()
+	firstByte, n, err := copyTimed(downloadHash, download.Body)
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(downloadStart)
+
+	for {
+		ev, err := nextSelfTestEvent(events)
+		if err != nil {
+			return err
+		}
+		if ev.Event == "done" {
+			break
+		}
+		if ev.Event == "error" || ev.Event == "timeout" {
+			return fmt.Errorf("upload failed: %s", ev.Message)
+		}
+	}
+	if n != size || !bytes.Equal(uploadHash.Sum(nil), downloadHash.Sum(nil)) {
+		return errors.New("the downloaded data differs from the uploaded data")
+	}
+
+	fmt.Printf("Upload registered in %s.\n", registered.Round(time.Microsecond))
+	fmt.Printf("First byte downloaded in %s.\n", firstByte.Sub(downloadStart).Round(time.Microsecond))
+	fmt.Printf("Transferred %s in %s (%s/s).\n", formatBytes(n), elapsed.Round(time.Millisecond), formatBytes(int64(float64(n)/elapsed.Seconds())))
+	return nil
+}
+
+// nextSelfTestEvent reads the next status event of the upload.
+func nextSelfTestEvent(events *bufio.Scanner) (statusEvent, error) {
+	var ev statusEvent
+	if !events.Scan() {
+		if err := events.Err(); err != nil {
+			return ev, err
+		}
+		return ev, io.ErrUnexpectedEOF
+	}
+	err := json.Unmarshal(events.Bytes(), &ev)
+	return ev, err
+}
+
+// copyTimed copies src to dst and returns when the first byte arrived.
+func copyTimed(dst io.Writer, src io.Reader) (time.Time, int64, error) {
+	var first time.Time
+	buf := make([]byte, 64*1024)
+	var n int64
+	for {
+		m, err := src.Read(buf)
+		if m > 0 {
+			if first.IsZero() {
+				first = time.Now()
+			}
+			dst.Write(buf[:m])
+			n += int64(m)
+		}
+		if err == io.EOF {
+			return first, n, nil
+		}
+		if err != nil {
+			return first, n, err
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "os"
+
+// startService does nothing, since services are only run by the Windows
+// service manager.
+func startService(quit chan<- os.Signal) {}
+
+// serviceStopped does nothing outside Windows.
+func serviceStopped() {}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Whether the process was started by the Windows service manager, as set in the service's command line.
+var serviceMode = flag.Bool("service", false, "run as a Windows service, logging to the event log")
+
+// Name of the Windows service and of its event log source.
+const serviceName = "streamer"
+
+var (
+	advapi32                          = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW   = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerExW = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus              = advapi32.NewProc("SetServiceStatus")
+	procRegisterEventSourceW          = advapi32.NewProc("RegisterEventSourceW")
+	procReportEventW                  = advapi32.NewProc("ReportEventW")
+)
+
+// Values of the Windows service API.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStateStopped     = 1
+	serviceStateStopPending = 3
+	serviceStateRunning     = 4
+	serviceAcceptStop       = 1
+	serviceAcceptShutdown   = 4
+
+	serviceControlStop     = 1
+	serviceControlShutdown = 5
+
+	eventlogInformationType = 4
+)
+
+// serviceStatus is the SERVICE_STATUS structure.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+// serviceTableEntry is the SERVICE_TABLE_ENTRYW structure.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// State of the running service.
+var service struct {
+	handle     uintptr
+	quit       chan<- os.Signal
+	registered chan bool     // Whether the control handler was registered.
+	stop       chan struct{} // Closed when the server shut down.
+	done       chan struct{} // Closed when the service manager was told.
+}
+
+// startService connects to the Windows service manager if the process runs
+// as a service, so that stopping the service sends os.Interrupt to quit, and
+// sends the log to the event log.
+func startService(quit chan<- os.Signal) {
+	if !*serviceMode {
+		return
+	}
+	service.quit = quit
+	service.registered = make(chan bool, 1)
+	service.stop = make(chan struct{})
+	service.done = make(chan struct{})
+
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	if h, _, _ := procRegisterEventSourceW.Call(0, uintptr(unsafe.Pointer(name))); h != 0 {
+		log.SetOutput(eventLogWriter{h})
+	}
+
+	go func() {
+		defer close(service.done)
+		table := []serviceTableEntry{{name, syscall.NewCallback(serviceMain)}, {}}
+		if r, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0]))); r == 0 {
+			log.Printf("Error connecting to the service manager. %s", err)
+			service.registered <- false
+		}
+	}()
+	if !<-service.registered {
+		log.Fatal("Error starting the service.")
+	}
+}
+
+// serviceStopped tells the service manager that the service stopped.
+func serviceStopped() {
+	if !*serviceMode {
+		return
+	}
+	close(service.stop)
+	select {
+	case <-service.done:
+	case <-time.After(5 * time.Second):
+	}
+}
+
+// serviceMain is the ServiceMain function of the service. It runs until the
+// server shuts down.
+func serviceMain(argc uintptr, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString(serviceName)
+	h, _, err := procRegisterServiceCtrlHandlerExW.Call(uintptr(unsafe.Pointer(name)), syscall.NewCallback(serviceHandler), 0)
+	if h == 0 {
+		log.Printf("Error registering the service control handler. %s", err)
+		service.registered <- false
+		return 0
+	}
+	service.handle = h
+	setServiceStatus(serviceStateRunning, 0)
+	service.registered <- true
+	<-service.stop
+	setServiceStatus(serviceStateStopped, 0)
+	return 0
+}
+
+// serviceHandler handles the controls sent by the service manager.
+func serviceHandler(control uintptr, eventType uintptr, eventData uintptr, context uintptr) uintptr {
+	switch control {
+	case serviceControlStop, serviceControlShutdown:
+		setServiceStatus(serviceStateStopPending, drainTimeout+abortGracePeriod)
+		select {
+		case service.quit <- os.Interrupt:
+		default:
+		}
+	}
+	return 0
+}
+
+// setServiceStatus reports the state of the service, and how long the
+// service manager should wait for the next report while stopping.
+func setServiceStatus(state uint32, wait time.Duration) {
+	status := serviceStatus{
+		serviceType:  serviceWin32OwnProcess,
+		currentState: state,
+		waitHint:     uint32(wait / time.Millisecond),
+	}
+	if state == serviceStateRunning {
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown
+	}
+	procSetServiceStatus.Call(service.handle, uintptr(unsafe.Pointer(&status)))
+}
+
+// eventLogWriter writes each log line as an event of the event log.
+type eventLogWriter struct {
+	handle uintptr
+}
+
+func (w eventLogWriter) Write(p []byte) (int, error) {
+	msg, err := syscall.UTF16PtrFromString(strings.ReplaceAll(strings.TrimRight(string(p), "\n"), "\x00", ""))
+	if err != nil {
+		return 0, err
+	}
+	strs := [1]*uint16{msg}
+	r, _, err := procReportEventW.Call(w.handle, eventlogInformationType, 0, 1, 0, 1, 0, uintptr(unsafe.Pointer(&strs[0])), 0)
+	if r == 0 {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"log"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Characters of short link codes. Defaults to lowercase letters and digits without look-alikes such as 0, o, 1 and l.
+var shortLinkAlphabet = os.Getenv("SHORT_LINK_ALPHABET")
+
+// Length of short link codes (e.g., 6). Short links are disabled when zero.
+var shortLinkLength int
+
+// Shortest short link codes allowed, so that they are not easily guessed and
+// rarely collide.
+const minShortLinkLength = 6
+
+// Codes tried for a new short link before giving up on collisions.
+const maxShortCodeAttempts = 10
+
+// Route prefix of short links.
+const shortLinkPrefix = "/s/"
+
+var errNoShortCode = &statusError{http.StatusServiceUnavailable, "No short link is available. Try again later."}
+
+// File IDs keyed by short link code, guarded by clientsRWMutex.
+var shortLinks = make(map[string]string)
+
+// newShortCode returns a random short link code that is not in use, or
+// errNoShortCode if the codes tried were all taken. clientsRWMutex must be
+// held.
+func newShortCode() (string, error) {
+	alphabet := []rune(shortLinkAlphabet)
+	max := big.NewInt(int64(len(alphabet)))
+	for attempt := 0; attempt < maxShortCodeAttempts; attempt++ {
+		var code strings.Builder
+		for i := 0; i < shortLinkLength; i++ {
+			n, err := cryptorand.Int(cryptorand.Reader, max)
+			if err != nil {
+				log.Panicf("Error generating short link. %s", err)
+			}
+			code.WriteRune(alphabet[n.Int64()])
+		}
+		if _, ok := shortLinks[code.String()]; !ok {
+			return code.String(), nil
+		}
+	}
+	return "", errNoShortCode
+}
+
+// shortLink redirects a short link to the download link of its transfer,
+// keeping the query string (e.g., a confirmation code).
+func shortLink(w http.ResponseWriter, r *http.Request) {
+	code := strings.TrimPrefix(r.URL.Path, shortLinkPrefix)
+	clientsRWMutex.RLock()
+	fileID, ok := shortLinks[code]
+	clientsRWMutex.RUnlock()
+	if !ok || shortLinkLength == 0 {
+		notFound(w, r)
+		return
+	}
+	target := baseURL(r) + "/" + prefix + "/" + fileID
+	if r.URL.RawQuery != "" {
+		target += "?" + r.URL.RawQuery
+	}
+	http.Redirect(w, r, target, http.StatusFound)
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/hmac"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Secret key of signed upload URLs. A random key is used if empty, so signed URLs stop working
+// when the server restarts.
+var signingKey = []byte(os.Getenv("SIGNING_KEY"))
+
+// Longest validity of a signed upload URL (e.g., 168h).
+var maxSignedURLTTL time.Duration
+
+// Validity of a signed upload URL when not given.
+const defaultSignedURLTTL = time.Hour
+
+var errInvalidSignature = errors.New("The upload link is invalid or expired.")
+var errSignatureUsed = errors.New("The upload link was already used.")
+
+// Upload options that need the credentials, since they reach beyond the file
+// a signed URL allows. Uploads to signed URLs may not set them.
+var credentialedUploadOptions = []string{"email", "public", "id", "archive", "wait", "confirm"}
+
+// Nonces of signed URLs that were used, with their expiry.
+var usedNonces = make(map[string]time.Time)
+var usedNoncesMutex sync.Mutex
+
+// signedUpload is the JSON reply to a request for a signed upload URL.
+type signedUpload struct {
+	UploadURL string    `json:"upload_url"`
+	Expires   time.Time `json:"expires"`
+	MaxSize   int64     `json:"max_size,omitempty"`
+}
+
+// initSigningKey generates a random signing key if SIGNING_KEY is not set.
+func initSigningKey() {
+	if len(signingKey) > 0 {
+		return
+	}
+	signingKey = make([]byte, 32)
+	if _, err := cryptorand.Read(signingKey); err != nil {
+		log.Panicf("Error generating signing key. %s", err)
+	}
+}
+
+// uploadSignature returns the signature of an upload URL for the given file
+// name, expiry, size limit and nonce.
+func uploadSignature(name string, expires int64, maxSize int64, nonce string) string {
+	mac := hmac.New(sha256.New, signingKey)
+	fmt.Fprintf(mac, "%s\n%d\n%d\n%s", name, expires, maxSize, nonce)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// sign lets the uploader mint a time-limited URL that uploads a single file
+// without credentials. The file name, size limit and validity are taken from
+// the name, max_size and ttl query parameters.
+func sign(w http.ResponseWriter, r *http.Request) {
+	if !authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="streamer"`)
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	query := r.URL.Query()
+	var name string
+	if n := query.Get("name"); n != "" {
+		name = sanitizeFileName(n)
+	}
+	ttl := defaultSignedURLTTL
+	if s := query.Get("ttl"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil || d <= 0 {
+			http.Error(w, fmt.Sprintf("invalid ttl %q", s), http.StatusBadRequest)
+			return
+		}
+		ttl = d
+	}
+	if ttl > maxSignedURLTTL {
+		ttl = maxSignedURLTTL
+	}
+	var maxSize int64
+	if s := query.Get("max_size"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n <= 0 {
+			http.Error(w, fmt.Sprintf("invalid max_size %q", s), http.StatusBadRequest)
+			return
+		}
+		maxSize = n
+	}
+
+	b := make([]byte, 12)
+	if _, err := cryptorand.Read(b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	nonce := base64.RawURLEncoding.EncodeToString(b)
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+
+	params := url.Values{}
+	params.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if maxSize > 0 {
+		params.Set("max_size", strconv.FormatInt(maxSize, 10))
+	}
+	params.Set("nonce", nonce)
+	params.Set("sig", uploadSignature(name, expires.Unix(), maxSize, nonce))
+	audit(r, "link_signed", "", name, fmt.Sprintf("expires %s", expires.UTC().Format(time.RFC3339)))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(signedUpload{
+		UploadURL: fmt.Sprintf("%s/%s/%s?%s", baseURL(r), prefix, url.PathEscape(name), params.Encode()),
+		Expires:   expires,
+		MaxSize:   maxSize,
+	})
+}
+
+// verifySignedUpload checks the signature of an upload of the file name in
+// the URL to a signed URL, and that its nonce was not used. The nonce is used
+// up by useSignedUpload once the upload passed all checks.
+func verifySignedUpload(r *http.Request, name string) error {
+	if name != "" {
+		name = sanitizeFileName(name)
+	}
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return errInvalidSignature
+	}
+	var maxSize int64
+	if s := query.Get("max_size"); s != "" {
+		if maxSize, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return errInvalidSignature
+		}
+	}
+	nonce := query.Get("nonce")
+	expected := uploadSignature(name, expires, maxSize, nonce)
+	if !hmac.Equal([]byte(query.Get("sig")), []byte(expected)) {
+		return errInvalidSignature
+	}
+	if maxSize > 0 && (r.ContentLength < 0 || r.ContentLength > maxSize) {
+		return fmt.Errorf("The upload must have a Content-Length of at most %d bytes.", maxSize)
+	}
+	for _, option := range credentialedUploadOptions {
+		if query.Has(option) {
+			return fmt.Errorf("The %s option is not allowed on signed upload links.", option)
+		}
+	}
+
+	usedNoncesMutex.Lock()
+	defer usedNoncesMutex.Unlock()
+	if _, ok := usedNonces[nonce]; ok {
+		return errSignatureUsed
+	}
+	return nil
+}
+
+// useSignedUpload uses up the nonce of an upload to a signed URL that
+// verifySignedUpload accepted, so the URL cannot upload again.
+func useSignedUpload(r *http.Request) error {
+	query := r.URL.Query()
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil {
+		return errInvalidSignature
+	}
+	nonce := query.Get("nonce")
+
+	usedNoncesMutex.Lock()
+	defer usedNoncesMutex.Unlock()
+	now := time.Now()
+	for n, exp := range usedNonces {
+		if now.After(exp) {
+			delete(usedNonces, n)
+		}
+	}
+	if _, ok := usedNonces[nonce]; ok {
+		return errSignatureUsed
+	}
+	usedNonces[nonce] = time.Unix(expires, 0)
+	return nil
+}
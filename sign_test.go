@@ -0,0 +1,126 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// signedRequest returns an upload of size bytes to the file name with the
+// signed query of name, expires, maxSize and nonce, followed by extra.
+func signedRequest(upload, name string, expires time.Time, maxSize, size int64, nonce, extra string) *http.Request {
+	params := url.Values{}
+	params.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	if maxSize > 0 {
+		params.Set("max_size", strconv.FormatInt(maxSize, 10))
+	}
+	params.Set("nonce", nonce)
+	params.Set("sig", uploadSignature(name, expires.Unix(), maxSize, nonce))
+	query := params.Encode()
+	if extra != "" {
+		query += "&" + extra
+	}
+	r := httptest.NewRequest("PUT", "/streamer/"+url.PathEscape(upload)+"?"+query, nil)
+	r.ContentLength = size
+	return r
+}
+
+// withSigningKey sets the signing key and clears the used nonces for a test.
+func withSigningKey(t *testing.T) {
+	key := signingKey
+	signingKey = []byte("0123456789abcdef0123456789abcdef")
+	t.Cleanup(func() {
+		signingKey = key
+		usedNoncesMutex.Lock()
+		usedNonces = make(map[string]time.Time)
+		usedNoncesMutex.Unlock()
+	})
+}
+
+func TestVerifySignedUpload(t *testing.T) {
+	withSigningKey(t)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		name string
+		r    *http.Request
+		ok   bool
+	}{
+		{"valid", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", ""), true},
+		{"valid without a name", signedRequest("", "", future, 0, 10, "n1", ""), true},
+		{"within max_size", signedRequest("a.txt", "a.txt", future, 10, 10, "n1", ""), true},
+		{"options the link allows", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "inline=true&note=hi"), true},
+		{"expired", signedRequest("a.txt", "a.txt", time.Now().Add(-time.Second), 0, 10, "n1", ""), false},
+		{"other name", signedRequest("b.txt", "a.txt", future, 0, 10, "n1", ""), false},
+		{"name added", signedRequest("a.txt", "", future, 0, 10, "n1", ""), false},
+		{"over max_size", signedRequest("a.txt", "a.txt", future, 10, 11, "n1", ""), false},
+		{"unknown size with max_size", signedRequest("a.txt", "a.txt", future, 10, -1, "n1", ""), false},
+		{"email", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "email=a@example.com"), false},
+		{"public", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "public=true"), false},
+		{"id", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "id=abcdefghijklmnop"), false},
+		{"archive", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "archive=true"), false},
+		{"wait", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "wait=1h"), false},
+		{"confirm", signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "confirm=true"), false},
+	}
+	for _, test := range tests {
+		name := test.r.URL.Path[len("/streamer/"):]
+		if err := verifySignedUpload(test.r, name); (err == nil) != test.ok {
+			t.Errorf("%s: got %v, want ok %v", test.name, err, test.ok)
+		}
+	}
+}
+
+// TestVerifySignedUploadTampered checks that changing any signed parameter
+// invalidates the signature.
+func TestVerifySignedUploadTampered(t *testing.T) {
+	withSigningKey(t)
+	future := time.Now().Add(time.Hour)
+	tests := []struct {
+		param string
+		value string
+	}{
+		{"expires", strconv.FormatInt(future.Add(time.Hour).Unix(), 10)},
+		{"max_size", "100"},
+		{"nonce", "n2"},
+		{"sig", uploadSignature("a.txt", future.Unix(), 0, "n2")},
+		{"sig", ""},
+	}
+	for _, test := range tests {
+		r := signedRequest("a.txt", "a.txt", future, 10, 10, "n1", "")
+		query := r.URL.Query()
+		query.Set(test.param, test.value)
+		r.URL.RawQuery = query.Encode()
+		if err := verifySignedUpload(r, "a.txt"); err != errInvalidSignature {
+			t.Errorf("%s=%s: got %v, want %v", test.param, test.value, err, errInvalidSignature)
+		}
+	}
+}
+
+func TestUseSignedUpload(t *testing.T) {
+	withSigningKey(t)
+	future := time.Now().Add(time.Hour)
+	r := signedRequest("a.txt", "a.txt", future, 0, 10, "n1", "")
+	if err := verifySignedUpload(r, "a.txt"); err != nil {
+		t.Fatal(err)
+	}
+	// Verifying alone leaves the link usable.
+	if err := verifySignedUpload(r, "a.txt"); err != nil {
+		t.Fatalf("verified again: %v", err)
+	}
+	if err := useSignedUpload(r); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifySignedUpload(r, "a.txt"); err != errSignatureUsed {
+		t.Errorf("verified after use: got %v, want %v", err, errSignatureUsed)
+	}
+	if err := useSignedUpload(r); err != errSignatureUsed {
+		t.Errorf("used twice: got %v, want %v", err, errSignatureUsed)
+	}
+	// Other links are not affected.
+	other := signedRequest("a.txt", "a.txt", future, 0, 10, "n2", "")
+	if err := verifySignedUpload(other, "a.txt"); err != nil {
+		t.Errorf("other nonce: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Comma-separated STUN and TURN server URLs offered to browsers for direct WebRTC transfers (e.g., stun:stun.l.google.com:19302).
+var iceServers = os.Getenv("WEBRTC_ICE_SERVERS")
+
+// Maximum size of a signaling message such as an SDP offer.
+const maxSignalSize = 64 << 10
+
+// Signaling messages held for a peer that is not reading them yet.
+const signalQueueSize = 64
+
+// Peers of a transfer exchanging signaling messages.
+const (
+	uploaderRole = iota
+	receiverRole
+)
+
+// signaling relays WebRTC signaling messages (SDP offers and answers and ICE
+// candidates) between the uploader and the receiver, so that browsers can
+// try a direct data channel before falling back to the relayed download.
+// A peer POSTs messages for the other peer and reads its own with GET as a
+// stream of Server-Sent Events.
+func signaling(w http.ResponseWriter, r *http.Request, fileID string) {
+	clientsRWMutex.RLock()
+	client, ok := clients[fileID]
+	clientsRWMutex.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+
+	var role int
+	switch r.URL.Query().Get("role") {
+	case "uploader":
+		if !authenticate(r) {
+			writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+			return
+		}
+		role = uploaderRole
+	case "receiver":
+		code := r.URL.Query().Get("code")
+		if code == "" {
+			code = r.Header.Get("X-Streamer-Code")
+		}
+		if client.code != "" && subtle.ConstantTimeCompare([]byte(code), []byte(client.code)) != 1 {
+			http.Error(w, "Invalid confirmation code.\n", http.StatusForbidden)
+			return
+		}
+		role = receiverRole
+	default:
+		http.Error(w, "role must be uploader or receiver.\n", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == "POST" {
+		data, err := io.ReadAll(io.LimitReader(r.Body, maxSignalSize+1))
+		if err != nil || len(data) > maxSignalSize || !json.Valid(data) {
+			http.Error(w, "The message must be a JSON value of at most 64 KiB.\n", http.StatusBadRequest)
+			return
+		}
+		select {
+		case client.signals[1-role] <- json.RawMessage(data):
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Too many pending messages.\n", http.StatusTooManyRequests)
+		}
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "webserver doesn't support flushing", http.StatusInternalServerError)
+		return
+	}
+	// The status events tell when the transfer ends.
+	ended, _ := client.subscribe()
+	defer client.unsubscribe(ended)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	config, _ := json.Marshal(iceConfig())
+	fmt.Fprintf(w, "event: config\ndata: %s\n\n", config)
+	flusher.Flush()
+
+	heartbeat := newHeartbeat()
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case data := <-client.signals[role]:
+			if _, err := fmt.Fprintf(w, "event: signal\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case _, ok := <-ended:
+			if !ok {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// rtcConfiguration is the part of an RTCPeerConnection configuration set by
+// the server.
+type rtcConfiguration struct {
+	ICEServers []rtcIceServer `json:"iceServers"`
+}
+
+type rtcIceServer struct {
+	URLs []string `json:"urls"`
+}
+
+// iceConfig returns the ICE servers peers use to traverse NAT.
+func iceConfig() rtcConfiguration {
+	config := rtcConfiguration{ICEServers: []rtcIceServer{}}
+	var urls []string
+	for _, url := range strings.Split(iceServers, ",") {
+		if url = strings.TrimSpace(url); url != "" {
+			urls = append(urls, url)
+		}
+	}
+	if len(urls) > 0 {
+		config.ICEServers = append(config.ICEServers, rtcIceServer{URLs: urls})
+	}
+	return config
+}
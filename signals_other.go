@@ -0,0 +1,14 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signals that gracefully shut down the server.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}
+
+// Signal that hands the listeners to a new process before shutting down.
+var handoffSignal os.Signal = syscall.SIGUSR2
@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// Signals that gracefully shut down the server. Windows delivers Ctrl+C and
+// Ctrl+Break as os.Interrupt, and the service manager stops the service
+// through startService.
+var shutdownSignals = []os.Signal{os.Interrupt}
+
+// Handing off listeners is not supported on Windows.
+var handoffSignal os.Signal
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Directory where parallel transfers are spooled so a client can download them over several ranged connections.
+// Parallel downloads are disabled when empty.
+var spoolDir = os.Getenv("SPOOL_DIR")
+
+var errDownloadIncomplete = errors.New("The download stopped before the whole file was received.")
+
+// byteRange is the half-open interval [start, end) of a file.
+type byteRange struct {
+	start, end int64
+}
+
+// spool holds a transfer in a temporary file as it is uploaded, so that
+// ranged downloads can read any part of it once it arrives.
+type spool struct {
+	file  *os.File
+	size  int64
+	ready chan struct{} // Closed when the upload starts filling the spool.
+
+	// Size of the segments of a segmented transfer, or zero, and the digest
+	// algorithm and hash of the segment being spooled.
+	segmentSize int64
+	digest      string
+	hash        hash.Hash
+
+	mu       sync.Mutex
+	cond     *sync.Cond  // Signals writes to the spool.
+	written  int64       // Bytes of the file spooled so far.
+	err      error       // Set once no more bytes will be spooled early.
+	served   []byteRange // Sorted, merged ranges sent to the client.
+	complete chan bool   // Signaled once every byte was sent to the client.
+
+	digests    [][]byte // Digests of the segments spooled so far.
+	acked      []bool   // Segments the client acknowledged.
+	ackedCount int
+}
+
+// newSpool creates a spool for a file of size bytes in spoolDir. If
+// segmentSize is not zero, the file is also split into segments that the
+// client acknowledges, with digests using the named algorithm.
+func newSpool(size, segmentSize int64, digest string) (*spool, error) {
+	file, err := os.CreateTemp(spoolDir, "streamer-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &spool{
+		file:        file,
+		size:        size,
+		ready:       make(chan struct{}),
+		complete:    make(chan bool, 1),
+		segmentSize: segmentSize,
+		digest:      digest,
+	}
+	s.cond = sync.NewCond(&s.mu)
+	if segmentSize > 0 {
+		s.hash = digestAlgorithms[digest]()
+		s.acked = make([]bool, s.segments())
+	}
+	return s, nil
+}
+
+// Write appends p to the spool and wakes up the downloads waiting for it.
+func (s *spool) Write(p []byte) (int, error) {
+	n, err := s.file.Write(p)
+	if s.segmentSize > 0 {
+		s.digestSegments(p[:n], s.written)
+	}
+	s.mu.Lock()
+	s.written += int64(n)
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	return n, err
+}
+
+// readAt reads spooled bytes at off, waiting until at least one is available.
+func (s *spool) readAt(p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	for s.written <= off && s.err == nil {
+		s.cond.Wait()
+	}
+	available, err := s.written-off, s.err
+	s.mu.Unlock()
+	if available <= 0 {
+		return 0, err
+	}
+	if int64(len(p)) > available {
+		p = p[:available]
+	}
+	return s.file.ReadAt(p, off)
+}
+
+// markServed records that the bytes in [start, end) were sent to the client.
+func (s *spool) markServed(start, end int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ranges := append(s.served, byteRange{start, end})
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].start < ranges[j].start })
+	merged := ranges[:0]
+	for _, br := range ranges {
+		if n := len(merged); n > 0 && br.start <= merged[n-1].end {
+			if br.end > merged[n-1].end {
+				merged[n-1].end = br.end
+			}
+			continue
+		}
+		merged = append(merged, br)
+	}
+	s.served = merged
+	// Segmented transfers complete once acknowledged instead.
+	if s.segmentSize == 0 && len(merged) == 1 && merged[0].start == 0 && merged[0].end >= s.size {
+		s.signalComplete()
+	}
+}
+
+// signalComplete tells the uploader that the client received the file.
+func (s *spool) signalComplete() {
+	select {
+	case s.complete <- true:
+	default:
+	}
+}
+
+// servedBytes returns how many distinct bytes were sent to the client.
+func (s *spool) servedBytes() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var n int64
+	for _, br := range s.served {
+		n += br.end - br.start
+	}
+	return n
+}
+
+// close ends the downloads still waiting for bytes and deletes the spool file.
+func (s *spool) close() {
+	s.mu.Lock()
+	if s.err == nil {
+		s.err = errTransferEnded
+	}
+	s.mu.Unlock()
+	s.cond.Broadcast()
+	s.file.Close()
+	os.Remove(s.file.Name())
+}
+
+// serve sends the part of the spooled file requested by r, or all of it.
+func (s *spool) serve(w http.ResponseWriter, r *http.Request, c *client) {
+	h := w.Header()
+	setTransferHeaders(h, c, c.inlineFor(r))
+	start, end, partial, err := parseRange(r.Header.Get("Range"), s.size)
+	if err != nil {
+		h.Del("Content-Length")
+		h.Set("Content-Range", fmt.Sprintf("bytes */%d", s.size))
+		http.Error(w, err.Error(), http.StatusRequestedRangeNotSatisfiable)
+		return
+	}
+	if partial {
+		h.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end-1, s.size))
+		h.Set("Content-Length", strconv.FormatInt(end-start, 10))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.WriteHeader(http.StatusOK)
+	}
+	if r.Method == "HEAD" {
+		return
+	}
+	if start == end {
+		s.markServed(start, end)
+		return
+	}
+
+	buffer := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buffer)
+	for off := start; off < end; {
+		p := *buffer
+		if remaining := end - off; remaining < int64(len(p)) {
+			p = p[:remaining]
+		}
+		n, err := s.readAt(p, off)
+		if n > 0 {
+			if _, werr := w.Write(p[:n]); werr != nil {
+				return
+			}
+			s.markServed(off, off+int64(n))
+			off += int64(n)
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// joinedBy reports whether r is a further connection of the client
+// downloading the spooled transfer of c, which presents the join token of its
+// first connection in the X-Streamer-Join-Token header or the join query
+// parameter. The caller holds clientsRWMutex.
+func (c *client) joinedBy(r *http.Request) bool {
+	if c.spool == nil || c.receiver == nil || !c.receiver.started {
+		return false
+	}
+	token := r.Header.Get("X-Streamer-Join-Token")
+	if token == "" {
+		token = r.URL.Query().Get("join")
+	}
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(c.receiver.joinToken)) == 1
+}
+
+// parseRange parses a Range header with a single range (e.g., bytes=0-1023)
+// for a file of size bytes into the interval [start, end). Without a usable
+// header, partial is false and the interval covers the whole file.
+func parseRange(header string, size int64) (start, end int64, partial bool, err error) {
+	if !strings.HasPrefix(header, "bytes=") || strings.Contains(header, ",") {
+		// Multiple ranges are not supported; send the whole file instead.
+		return 0, size, false, nil
+	}
+	first, last, ok := strings.Cut(strings.TrimSpace(strings.TrimPrefix(header, "bytes=")), "-")
+	if !ok {
+		return 0, 0, false, fmt.Errorf("invalid range %q", header)
+	}
+	if first == "" {
+		// Suffix range: the last bytes of the file.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false, fmt.Errorf("invalid range %q", header)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size, true, nil
+	}
+	start, err = strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false, fmt.Errorf("invalid range %q", header)
+	}
+	end = size
+	if last != "" {
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n < start {
+			return 0, 0, false, fmt.Errorf("invalid range %q", header)
+		}
+		if n+1 < size {
+			end = n + 1
+		}
+	}
+	return start, end, true, nil
+}
+
+// awaitDownloads waits until the client downloaded every byte of the spool.
+// It gives up once the downloads made no progress for timeout.
+func (c *client) awaitDownloads(r *http.Request, timeout time.Duration) int {
+	for {
+		served := c.spool.servedBytes()
+		outcome := c.await(r, c.spool.complete, timeout, "Waiting for the download to complete...")
+		if outcome != awaitTimeout || c.spool.servedBytes() == served {
+			return outcome
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		header     string
+		size       int64
+		start, end int64
+		partial    bool
+		err        bool
+	}{
+		{"", 100, 0, 100, false, false},
+		{"bytes=0-", 100, 0, 100, true, false},
+		{"bytes=0-0", 100, 0, 1, true, false},
+		{"bytes=10-19", 100, 10, 20, true, false},
+		{"bytes=10-", 100, 10, 100, true, false},
+		{"bytes=99-", 100, 99, 100, true, false},
+		{"bytes=90-99", 100, 90, 100, true, false},
+		{"bytes=90-200", 100, 90, 100, true, false},
+		{"bytes= 10-19", 100, 10, 20, true, false},
+		{"bytes=-10", 100, 90, 100, true, false},
+		{"bytes=-100", 100, 0, 100, true, false},
+		{"bytes=-200", 100, 0, 100, true, false},
+		{"bytes=0-9,20-29", 100, 0, 100, false, false},
+		{"items=0-9", 100, 0, 100, false, false},
+		{"bytes=100-", 100, 0, 0, false, true},
+		{"bytes=100-199", 100, 0, 0, false, true},
+		{"bytes=0-", 0, 0, 0, false, true},
+		{"bytes=20-10", 100, 0, 0, false, true},
+		{"bytes=-0", 100, 0, 0, false, true},
+		{"bytes=-", 100, 0, 0, false, true},
+		{"bytes=10", 100, 0, 0, false, true},
+		{"bytes=a-b", 100, 0, 0, false, true},
+		{"bytes=-5-10", 100, 0, 0, false, true},
+		{"bytes=10--20", 100, 0, 0, false, true},
+	}
+	for _, test := range tests {
+		start, end, partial, err := parseRange(test.header, test.size)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseRange(%q, %d) = %d, %d, %v, want an error", test.header, test.size, start, end, partial)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRange(%q, %d): %v", test.header, test.size, err)
+			continue
+		}
+		if start != test.start || end != test.end || partial != test.partial {
+			t.Errorf("parseRange(%q, %d) = %d, %d, %v, want %d, %d, %v", test.header, test.size, start, end, partial, test.start, test.end, test.partial)
+		}
+	}
+}
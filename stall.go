@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// How long the uploader may send no data during a transfer before it is aborted (e.g., 2m). Disabled when zero.
+var uploadStallTimeout time.Duration
+
+// How long the receiver may accept no data during a transfer before it is aborted (e.g., 2m). Disabled when zero.
+var downloadStallTimeout time.Duration
+
+// connContextKey is the request context key of the client connection.
+type connContextKey struct{}
+
+// withConn stores the client connection in the context of its requests, so
+// that handlers can set deadlines on it.
+func withConn(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, connContextKey{}, c)
+}
+
+// requestConn returns the connection of r, or nil if it is shared with other
+// requests as in HTTP/2.
+func requestConn(r *http.Request) net.Conn {
+	if r.ProtoMajor != 1 {
+		return nil
+	}
+	conn, _ := r.Context().Value(connContextKey{}).(net.Conn)
+	return conn
+}
+
+// stalled reports that the peer on side moved no data for timeout.
+func stalled(side string, timeout time.Duration) error {
+	return &statusError{http.StatusGatewayTimeout, fmt.Sprintf("The %s stalled: no data moved for %s.", side, timeout)}
+}
+
+// isTimeout reports whether err is a deadline being exceeded.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statusEvent is a status update about a transfer sent to the uploader.
+type statusEvent struct {
+	Event       string     `json:"event"`
+	Message     string     `json:"message,omitempty"`
+	ID          string     `json:"id,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	ShortURL    string     `json:"short_url,omitempty"`
+	Expires     *time.Time `json:"expires,omitempty"`
+	Code        string     `json:"code,omitempty"`       // Confirmation code the receiver must present.
+	IP          string     `json:"ip,omitempty"`         // Address of the receiving client.
+	Hostname    string     `json:"hostname,omitempty"`   // Reverse DNS name of the receiving client.
+	UserAgent   string     `json:"user_agent,omitempty"` // User-Agent of the receiving client.
+	Position    int        `json:"position,omitempty"`   // Queue position of a waiting client.
+	Bytes       int64      `json:"bytes,omitempty"`      // Bytes relayed so far.
+	Size        int64      `json:"size,omitempty"`       // Total bytes, if known.
+	Rate        float64    `json:"rate,omitempty"`       // Bytes per second.
+	ETA         float64    `json:"eta,omitempty"`        // Estimated seconds remaining.
+	Elapsed     float64    `json:"elapsed,omitempty"`    // Seconds since the transfer started streaming.
+}
+
+// uploadStatus writes status events to the uploader's hijacked connection,
+// either as plain text lines for humans or as NDJSON for API clients.
+type uploadStatus struct {
+	mu      sync.Mutex
+	w       *responseLogWriter
+	json    bool
+	started bool          // Whether the status line was written.
+	held    []statusEvent // Events sent before the status line.
+}
+
+// writeContinue tells an uploader that sent Expect: 100-continue to send the
+// request body.
+func (s *uploadStatus) writeContinue() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+	return s.w.body.Flush()
+}
+
+// writeHeader writes the response status line and headers, followed by the
+// first events and then by the events sent before it.
+func (s *uploadStatus) writeHeader(code int, first ...statusEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.json {
+		s.w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		s.w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	s.w.Header().Set("Connection", "close")
+	fmt.Fprintf(s.w.body, "HTTP/1.1 %d %s\r\n", code, http.StatusText(code))
+	s.w.Header().Write(s.w.body)
+	s.w.WriteString("\r\n")
+	s.started = true
+	for _, ev := range append(first, s.held...) {
+		if err := s.write(ev); err != nil {
+			return err
+		}
+	}
+	s.held = nil
+	return s.w.body.Flush()
+}
+
+// send writes an event and flushes it to the uploader. Events sent before the
+// status line are held until writeHeader.
+func (s *uploadStatus) send(ev statusEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		s.held = append(s.held, ev)
+		return nil
+	}
+	if err := s.write(ev); err != nil {
+		return err
+	}
+	return s.w.body.Flush()
+}
+
+// reject writes the status line with code and an error event with message.
+func (s *uploadStatus) reject(code int, message string) {
+	s.writeHeader(code)
+	s.send(statusEvent{Event: "error", Message: message})
+}
+
+// write writes an event without flushing it. s.mu must be held.
+func (s *uploadStatus) write(ev statusEvent) error {
+	if s.json {
+		return json.NewEncoder(s.w).Encode(ev)
+	}
+	_, err := s.w.Write([]byte(ev.Message + "\n"))
+	return err
+}
+
+// replace makes s write to the connection of other, which took over the
+// upload.
+func (s *uploadStatus) replace(other *uploadStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.w, s.json = other.w, other.json
+}
+
+// emit sends an event to the uploader and to any event stream subscribers.
+func (c *client) emit(ev statusEvent) error {
+	c.publish(ev)
+	return c.status.send(ev)
+}
+
+// publish sends an event to the event stream subscribers of c without
+// blocking. Subscribers that fall behind miss events.
+func (c *client) publish(ev statusEvent) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	c.lastEvent = ev
+	for ch := range c.subscribers {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// subscribe returns a channel receiving the events of c along with the last
+// event published before subscribing.
+func (c *client) subscribe() (chan statusEvent, statusEvent) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	ch := make(chan statusEvent, 16)
+	if c.subscribers == nil {
+		c.subscribers = make(map[chan statusEvent]struct{})
+	}
+	c.subscribers[ch] = struct{}{}
+	return ch, c.lastEvent
+}
+
+// unsubscribe stops sending events to ch.
+func (c *client) unsubscribe(ch chan statusEvent) {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	if _, ok := c.subscribers[ch]; ok {
+		delete(c.subscribers, ch)
+		close(ch)
+	}
+}
+
+// closeSubscribers ends all event streams of c.
+func (c *client) closeSubscribers() {
+	c.subscribersMutex.Lock()
+	defer c.subscribersMutex.Unlock()
+	for ch := range c.subscribers {
+		delete(c.subscribers, ch)
+		close(ch)
+	}
+}
+
+// events streams the status events of a transfer as Server-Sent Events. The
+// events describe the receiving client, so they require the upload
+// credentials.
+func events(w http.ResponseWriter, r *http.Request, fileID string) {
+	// Either side can watch the transfer, but only the uploader learns who the
+	// receiver is.
+	_, _, uploader := r.BasicAuth()
+	if uploader && !authenticate(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="streamer"`)
+		writeError(w, r, "unauthorized", http.StatusUnauthorized, "Invalid Credentials", "")
+		return
+	}
+
+	clientsRWMutex.RLock()
+	client, ok := clients[fileID]
+	clientsRWMutex.RUnlock()
+	if !ok {
+		notFound(w, r)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "webserver doesn't support flushing", http.StatusInternalServerError)
+		return
+	}
+
+	ch, last := client.subscribe()
+	defer client.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	if last.Event != "" {
+		if ev, ok := last.redacted(uploader); ok {
+			writeServerSentEvent(w, ev)
+		}
+	}
+	flusher.Flush()
+
+	heartbeat := newHeartbeat()
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-heartbeat.C:
+			// Comment lines keep the stream alive and are ignored by clients.
+			if _, err := io.WriteString(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case ev, ok := <-ch:
+			if !ok {
+				return
+			}
+			if ev, ok = ev.redacted(uploader); !ok {
+				continue
+			}
+			if writeServerSentEvent(w, ev) != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// redacted returns ev as sent to an event stream subscriber, without the
+// details that identify the receiving client unless the subscriber is the
+// uploader. Events that carry nothing else are dropped.
+func (ev statusEvent) redacted(uploader bool) (statusEvent, bool) {
+	if uploader {
+		return ev, true
+	}
+	if ev.Event == "hostname" {
+		return ev, false
+	}
+	if ev.IP != "" {
+		ev.Message = strings.Replace(ev.Message, " from "+ev.IP, "", 1)
+	}
+	if ev.UserAgent != "" {
+		ev.Message = strings.Replace(ev.Message, " ("+ev.UserAgent+")", "", 1)
+	}
+	ev.IP, ev.Hostname, ev.UserAgent, ev.Code = "", "", "", ""
+	return ev, true
+}
+
+// writeServerSentEvent writes ev in the text/event-stream format.
+func writeServerSentEvent(w io.Writer, ev statusEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.Event, data)
+	return err
+}
+
+// acceptsJSON reports whether the request asks for JSON responses.
+func acceptsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, _, err := mime.ParseMediaType(accept)
+		if err == nil && (mediaType == "application/json" || mediaType == "application/x-ndjson") {
+			return true
+		}
+	}
+	return false
+}
+
+// reportProgress periodically sends the relay progress of c to the uploader
+// until stop is closed.
+func reportProgress(c *client, stop <-chan struct{}) {
+	if progressInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	last := c.transferred.Load()
+	lastTime := time.Now()
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			transferred := c.transferred.Load()
+			rate := float64(transferred-last) / now.Sub(lastTime).Seconds()
+			last, lastTime = transferred, now
+
+			ev := statusEvent{Event: "progress", Bytes: transferred, Rate: rate}
+			if c.size >= 0 {
+				ev.Size = c.size
+				if rate > 0 {
+					ev.ETA = float64(c.size-transferred) / rate
+				}
+				ev.Message = fmt.Sprintf("%s / %s, %s/s", formatBytes(transferred), formatBytes(c.size), formatBytes(int64(rate)))
+				if ev.ETA > 0 {
+					ev.Message += ", ETA " + time.Duration(ev.ETA*float64(time.Second)).Round(time.Second).String()
+				}
+			} else {
+				ev.Message = fmt.Sprintf("%s, %s/s", formatBytes(transferred), formatBytes(int64(rate)))
+			}
+			if c.emit(ev) != nil {
+				return
+			}
+		}
+	}
+}
+
+// doneEvent reports a completed transfer with its size, duration and
+// average throughput, so that short or slow transfers stand out.
+func (c *client) doneEvent() statusEvent {
+	transferred := c.transferred.Load()
+	elapsed := time.Since(c.startedAt)
+	rate := float64(transferred) / elapsed.Seconds()
+	return statusEvent{
+		Event:   "done",
+		Message: fmt.Sprintf("%s was transferred successfully: %s in %s (%s/s).", c.fileName, formatBytes(transferred), elapsed.Round(time.Millisecond), formatBytes(int64(rate))),
+		Bytes:   transferred,
+		Size:    transferred,
+		Rate:    rate,
+		Elapsed: elapsed.Seconds(),
+	}
+}
+
+// Trailers of a download reporting the transfer statistics.
+const statsTrailers = "X-Streamer-Bytes, X-Streamer-Elapsed"
+
+// setStatsTrailers reports the bytes and duration of a completed transfer to
+// the receiver in the trailers announced by relay. Trailers are only sent
+// over HTTP/2 or when the response is chunked, since the size was unknown.
+func setStatsTrailers(h http.Header, c *client) {
+	h.Set("X-Streamer-Bytes", strconv.FormatInt(c.transferred.Load(), 10))
+	h.Set("X-Streamer-Elapsed", strconv.FormatFloat(time.Since(c.startedAt).Seconds(), 'f', 3, 64))
+}
+
+// formatBytes formats n using binary units, e.g. 1.2 GiB.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog connects to the local syslog daemon.
+func openSyslog() (io.Writer, error) {
+	return syslog.New(syslog.LOG_AUTH|syslog.LOG_INFO, "streamer")
+}
@@ -0,0 +1,11 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// openSyslog fails, since Windows has no syslog daemon.
+func openSyslog() (io.Writer, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set with -ldflags "-X main.version=1.2.0 -X main.commit=abc123 -X main.buildDate=2024-01-01".
+// The commit and build date default to the version control information embedded by go build.
+var version = "dev"
+var commit = ""
+var buildDate = ""
+
+// versionInfo is the JSON description of the running build.
+type versionInfo struct {
+	Version   string   `json:"version"`
+	Commit    string   `json:"commit"`
+	BuildDate string   `json:"build_date"`
+	GoVersion string   `json:"go_version"`
+	Features  features `json:"features"`
+}
+
+// features are the optional capabilities enabled on this server.
+type features struct {
+	TLS        bool   `json:"tls"`
+	Clustering bool   `json:"clustering"` // Transfers are only known to the instance they were uploaded to.
+	Spool      string `json:"spool"`      // Backend buffering parallel and segmented transfers: file or none.
+	Resume     bool   `json:"resume"`
+	CORS       bool   `json:"cors"`
+	Reconnect  bool   `json:"reconnect"` // Receivers can reconnect to a broken download.
+}
+
+// buildInfo returns the version of the running build.
+func buildInfo() versionInfo {
+	info := versionInfo{
+		Version:   version,
+		Commit:    commit,
+		BuildDate: buildDate,
+		GoVersion: runtime.Version(),
+		Features: features{
+			TLS:       tlsEnabled,
+			Spool:     "none",
+			Resume:    resumeTimeout > 0,
+			CORS:      corsAllowedOrigins != "",
+			Reconnect: downloadResumeTimeout > 0,
+		},
+	}
+	if spoolDir != "" {
+		info.Features.Spool = "file"
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range bi.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && info.Commit == "":
+				info.Commit = setting.Value
+			case setting.Key == "vcs.time" && info.BuildDate == "":
+				info.BuildDate = setting.Value
+			}
+		}
+	}
+	return info
+}
+
+// versionHandler describes the running build and its enabled features, so
+// that clients can detect capability mismatches.
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(buildInfo())
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH3 with the 64-bit output, seed 0 and the default secret. Like XXH64, it
+// only detects corruption, but it is faster on large inputs.
+
+const (
+	xxh3StripeLen       = 64
+	xxh3ConsumeRate     = 8 // Bytes of the secret each stripe advances by.
+	xxh3StripesPerBlock = (len(xxh3Secret) - xxh3StripeLen) / xxh3ConsumeRate
+	xxh3BufferLen       = 256
+	xxh3MidSizeMax      = 240
+
+	xxh32Prime1 uint64 = 0x9E3779B1
+	xxh32Prime2 uint64 = 0x85EBCA77
+	xxh32Prime3 uint64 = 0xC2B2AE3D
+)
+
+var xxh3Secret = [192]byte{
+	0xb8, 0xfe, 0x6c, 0x39, 0x23, 0xa4, 0x4b, 0xbe, 0x7c, 0x01, 0x81, 0x2c, 0xf7, 0x21, 0xad, 0x1c,
+	0xde, 0xd4, 0x6d, 0xe9, 0x83, 0x90, 0x97, 0xdb, 0x72, 0x40, 0xa4, 0xa4, 0xb7, 0xb3, 0x67, 0x1f,
+	0xcb, 0x79, 0xe6, 0x4e, 0xcc, 0xc0, 0xe5, 0x78, 0x82, 0x5a, 0xd0, 0x7d, 0xcc, 0xff, 0x72, 0x21,
+	0xb8, 0x08, 0x46, 0x74, 0xf7, 0x43, 0x24, 0x8e, 0xe0, 0x35, 0x90, 0xe6, 0x81, 0x3a, 0x26, 0x4c,
+	0x3c, 0x28, 0x52, 0xbb, 0x91, 0xc3, 0x00, 0xcb, 0x88, 0xd0, 0x65, 0x8b, 0x1b, 0x53, 0x2e, 0xa3,
+	0x71, 0x64, 0x48, 0x97, 0xa2, 0x0d, 0xf9, 0x4e, 0x38, 0x19, 0xef, 0x46, 0xa9, 0xde, 0xac, 0xd8,
+	0xa8, 0xfa, 0x76, 0x3f, 0xe3, 0x9c, 0x34, 0x3f, 0xf9, 0xdc, 0xbb, 0xc7, 0xc7, 0x0b, 0x4f, 0x1d,
+	0x8a, 0x51, 0xe0, 0x4b, 0xcd, 0xb4, 0x59, 0x31, 0xc8, 0x9f, 0x7e, 0xc9, 0xd9, 0x78, 0x73, 0x64,
+	0xea, 0xc5, 0xac, 0x83, 0x34, 0xd3, 0xeb, 0xc3, 0xc5, 0x81, 0xa0, 0xff, 0xfa, 0x13, 0x63, 0xeb,
+	0x17, 0x0d, 0xdd, 0x51, 0xb7, 0xf0, 0xda, 0x49, 0xd3, 0x16, 0x55, 0x26, 0x29, 0xd4, 0x68, 0x9e,
+	0x2b, 0x16, 0xbe, 0x58, 0x7d, 0x47, 0xa1, 0xfc, 0x8f, 0xf8, 0xb8, 0xd1, 0x7a, 0xd0, 0x31, 0xce,
+	0x45, 0xcb, 0x3a, 0x8f, 0x95, 0x16, 0x04, 0x28, 0xaf, 0xd7, 0xfb, 0xca, 0xbb, 0x4b, 0x40, 0x7e,
+}
+
+func xxh64Avalanche(h uint64) uint64 {
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	return h ^ h>>32
+}
+
+func xxh3Avalanche(h uint64) uint64 {
+	h ^= h >> 37
+	h *= 0x165667919E3779F9
+	return h ^ h>>32
+}
+
+func xxh3StrongAvalanche(h, n uint64) uint64 {
+	h ^= bits.RotateLeft64(h, 49) ^ bits.RotateLeft64(h, 24)
+	h *= 0x9FB21C651E98DF25
+	h ^= h>>35 + n
+	h *= 0x9FB21C651E98DF25
+	return h ^ h>>28
+}
+
+// xxh3Fold multiplies a and b into 128 bits and folds them into 64.
+func xxh3Fold(a, b uint64) uint64 {
+	hi, lo := bits.Mul64(a, b)
+	return hi ^ lo
+}
+
+func xxh3Mix16(p, secret []byte) uint64 {
+	return xxh3Fold(binary.LittleEndian.Uint64(p)^binary.LittleEndian.Uint64(secret), binary.LittleEndian.Uint64(p[8:])^binary.LittleEndian.Uint64(secret[8:]))
+}
+
+// xxh3Short hashes inputs of up to xxh3MidSizeMax bytes.
+func xxh3Short(p []byte) uint64 {
+	s := xxh3Secret[:]
+	n := len(p)
+	switch {
+	case n == 0:
+		return xxh64Avalanche(binary.LittleEndian.Uint64(s[56:]) ^ binary.LittleEndian.Uint64(s[64:]))
+	case n <= 3:
+		combo := uint32(p[0])<<16 | uint32(p[n>>1])<<24 | uint32(p[n-1]) | uint32(n)<<8
+		flip := binary.LittleEndian.Uint32(s) ^ binary.LittleEndian.Uint32(s[4:])
+		return xxh64Avalanche(uint64(combo) ^ uint64(flip))
+	case n <= 8:
+		flip := binary.LittleEndian.Uint64(s[8:]) ^ binary.LittleEndian.Uint64(s[16:])
+		in := uint64(binary.LittleEndian.Uint32(p[n-4:])) + uint64(binary.LittleEndian.Uint32(p))<<32
+		return xxh3StrongAvalanche(in^flip, uint64(n))
+	case n <= 16:
+		lo := binary.LittleEndian.Uint64(p) ^ binary.LittleEndian.Uint64(s[24:]) ^ binary.LittleEndian.Uint64(s[32:])
+		hi := binary.LittleEndian.Uint64(p[n-8:]) ^ binary.LittleEndian.Uint64(s[40:]) ^ binary.LittleEndian.Uint64(s[48:])
+		return xxh3Avalanche(uint64(n) + bits.ReverseBytes64(lo) + hi + xxh3Fold(lo, hi))
+	case n <= 128:
+		acc := uint64(n) * xxhPrime1
+		if n > 32 {
+			if n > 64 {
+				if n > 96 {
+					acc += xxh3Mix16(p[48:], s[96:]) + xxh3Mix16(p[n-64:], s[112:])
+				}
+				acc += xxh3Mix16(p[32:], s[64:]) + xxh3Mix16(p[n-48:], s[80:])
+			}
+			acc += xxh3Mix16(p[16:], s[32:]) + xxh3Mix16(p[n-32:], s[48:])
+		}
+		acc += xxh3Mix16(p, s) + xxh3Mix16(p[n-16:], s[16:])
+		return xxh3Avalanche(acc)
+	}
+	acc := uint64(n) * xxhPrime1
+	for i := 0; i < 8; i++ {
+		acc += xxh3Mix16(p[16*i:], s[16*i:])
+	}
+	acc = xxh3Avalanche(acc)
+	for i := 8; i < n/16; i++ {
+		acc += xxh3Mix16(p[16*i:], s[16*(i-8)+3:])
+	}
+	acc += xxh3Mix16(p[n-16:], s[136-17:])
+	return xxh3Avalanche(acc)
+}
+
+func xxh3Accumulate(acc *[8]uint64, stripe, secret []byte) {
+	for i := 0; i < 8; i++ {
+		v := binary.LittleEndian.Uint64(stripe[8*i:])
+		k := v ^ binary.LittleEndian.Uint64(secret[8*i:])
+		acc[i^1] += v
+		acc[i] += uint64(uint32(k)) * (k >> 32)
+	}
+}
+
+func xxh3Scramble(acc *[8]uint64) {
+	secret := xxh3Secret[len(xxh3Secret)-xxh3StripeLen:]
+	for i := range acc {
+		a := acc[i] ^ acc[i]>>47 ^ binary.LittleEndian.Uint64(secret[8*i:])
+		acc[i] = a * xxh32Prime1
+	}
+}
+
+// xxh3Consume accumulates n stripes of p, given the stripes already
+// accumulated in the current block, and returns the stripes of the block
+// after them.
+func xxh3Consume(acc *[8]uint64, done int, p []byte, n int) int {
+	for i := 0; i < n; i++ {
+		xxh3Accumulate(acc, p[xxh3StripeLen*i:], xxh3Secret[xxh3ConsumeRate*done:])
+		if done++; done == xxh3StripesPerBlock {
+			xxh3Scramble(acc)
+			done = 0
+		}
+	}
+	return done
+}
+
+// xxh3 is a streaming XXH3 hash.Hash. Input is buffered until more than
+// xxh3BufferLen bytes arrived, since short inputs are hashed differently, and
+// the last stripe is always accumulated by Sum.
+type xxh3 struct {
+	acc     [8]uint64
+	stripes int // Stripes accumulated in the current block.
+	total   uint64
+	buf     [xxh3BufferLen]byte
+	n       int // Bytes in buf.
+}
+
+func newXXH3() hash.Hash {
+	h := &xxh3{}
+	h.Reset()
+	return h
+}
+
+func (h *xxh3) Reset() {
+	*h = xxh3{acc: [8]uint64{xxh32Prime3, xxhPrime1, xxhPrime2, xxhPrime3, xxhPrime4, xxh32Prime2, xxhPrime5, xxh32Prime1}}
+}
+
+func (h *xxh3) Size() int      { return 8 }
+func (h *xxh3) BlockSize() int { return xxh3StripeLen }
+
+func (h *xxh3) Write(p []byte) (int, error) {
+	n := len(p)
+	h.total += uint64(n)
+	if h.n+len(p) <= len(h.buf) {
+		h.n += copy(h.buf[h.n:], p)
+		return n, nil
+	}
+	stripes := len(h.buf) / xxh3StripeLen
+	if h.n > 0 {
+		p = p[copy(h.buf[h.n:], p):]
+		h.stripes = xxh3Consume(&h.acc, h.stripes, h.buf[:], stripes)
+		h.n = 0
+	}
+	if len(p) > len(h.buf) {
+		var last []byte
+		for len(p) > len(h.buf) {
+			h.stripes = xxh3Consume(&h.acc, h.stripes, p, stripes)
+			last = p[len(h.buf)-xxh3StripeLen : len(h.buf)]
+			p = p[len(h.buf):]
+		}
+		// Sum takes the start of the last stripe from the end of the buffer
+		// when fewer than a stripe of bytes are buffered.
+		copy(h.buf[len(h.buf)-xxh3StripeLen:], last)
+	}
+	h.n = copy(h.buf[:], p)
+	return n, nil
+}
+
+func (h *xxh3) Sum(b []byte) []byte {
+	if h.total <= xxh3MidSizeMax {
+		return binary.BigEndian.AppendUint64(b, xxh3Short(h.buf[:h.n]))
+	}
+	acc := h.acc
+	lastSecret := xxh3Secret[len(xxh3Secret)-xxh3StripeLen-7:]
+	if h.n >= xxh3StripeLen {
+		xxh3Consume(&acc, h.stripes, h.buf[:], (h.n-1)/xxh3StripeLen)
+		xxh3Accumulate(&acc, h.buf[h.n-xxh3StripeLen:], lastSecret)
+	} else {
+		// The last stripe starts in the input accumulated before.
+		var last [xxh3StripeLen]byte
+		carried := copy(last[:], h.buf[len(h.buf)-(xxh3StripeLen-h.n):])
+		copy(last[carried:], h.buf[:h.n])
+		xxh3Accumulate(&acc, last[:], lastSecret)
+	}
+
+	result := h.total * xxhPrime1
+	secret := xxh3Secret[11:]
+	for i := 0; i < 4; i++ {
+		result += xxh3Fold(acc[2*i]^binary.LittleEndian.Uint64(secret[16*i:]), acc[2*i+1]^binary.LittleEndian.Uint64(secret[16*i+8:]))
+	}
+	return binary.BigEndian.AppendUint64(b, xxh3Avalanche(result))
+}